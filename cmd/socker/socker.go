@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/China-HPC/go-socker/pkg/socker"
 	"github.com/urfave/cli"
@@ -15,10 +16,25 @@ var (
 	verbose       bool
 	epilogEnabled bool
 	insecure      bool
+	bestEffort    bool
+	host          string
 	s             *socker.Socker
+	client        *socker.Client
 )
 
+// clientCommands are the commands can be served by socker daemon.
+var clientCommands = map[string]bool{
+	"run":  true,
+	"exec": true,
+	"ps":   true,
+	"logs": true,
+	"stop": true,
+}
+
 func main() {
+	if socker.IsSupervisor() {
+		os.Exit(socker.Supervise(os.Args[1:]))
+	}
 	app := cli.NewApp()
 	app.Name = "socker"
 	app.Usage = "Secure runner for Docker containers"
@@ -40,6 +56,17 @@ func main() {
 			Destination: &insecure,
 			Usage:       "run in insecure mode, strongly not recommended",
 		},
+		cli.BoolFlag{
+			Name:        "best-effort",
+			Destination: &bestEffort,
+			Usage:       "keep containers running if they can't be confined in the job cgroups, only for root",
+		},
+		cli.StringFlag{
+			Name:        "host, H",
+			Destination: &host,
+			EnvVar:      "SOCKER_HOST",
+			Usage:       "run commands via socker daemon listening on the unix socket",
+		},
 	}
 	app.Commands = []cli.Command{
 		{
@@ -81,7 +108,7 @@ func main() {
 						},
 					},
 					Before: func(c *cli.Context) error {
-						if s.CurrentUID != "0" {
+						if s.CurrentUID != "0" && !s.IsDelegated("images sync") {
 							log.Fatal("You have no permission to do this.")
 						}
 						return nil
@@ -90,7 +117,7 @@ func main() {
 						err := s.SyncImages(c.String("config"),
 							c.String("repo"), c.String("filter"))
 						if err != nil {
-							return cli.NewExitError(err.Error(), 1)
+							return cli.NewExitError(err.Error(), socker.ExitCode(err))
 						}
 						return nil
 					},
@@ -102,11 +129,7 @@ func main() {
 			Usage:           "run a container from IMAGE executing COMMAND as regular user",
 			SkipFlagParsing: true,
 			Action: func(c *cli.Context) error {
-				err := s.RunImage(c.Args())
-				if err != nil {
-					return cli.NewExitError(err, 1)
-				}
-				return nil
+				return call(c, s.RunImage)
 			},
 		},
 		{
@@ -114,9 +137,134 @@ func main() {
 			Usage:           "run a command in a running container as regular user",
 			SkipFlagParsing: true,
 			Action: func(c *cli.Context) error {
-				err := s.Exec(c.Args())
+				return call(c, s.Exec)
+			},
+		},
+		{
+			Name:            "ps",
+			Usage:           "list containers of current user",
+			SkipFlagParsing: true,
+			Action: func(c *cli.Context) error {
+				return call(c, s.Ps)
+			},
+		},
+		{
+			Name:            "logs",
+			Usage:           "fetch the logs of a container of current user",
+			SkipFlagParsing: true,
+			Action: func(c *cli.Context) error {
+				return call(c, s.Logs)
+			},
+		},
+		{
+			Name:            "stop",
+			Usage:           "stop containers of current user",
+			SkipFlagParsing: true,
+			Action: func(c *cli.Context) error {
+				return call(c, s.Stop)
+			},
+		},
+		{
+			Name:  "audit",
+			Usage: "verify the audit log (NOTE:common user have no permission to do this operation)",
+			Before: func(c *cli.Context) error {
+				if s.CurrentUID != "0" {
+					log.Fatal("You have no permission to do this.")
+				}
+				return nil
+			},
+			Subcommands: []cli.Command{
+				{
+					Name:      "verify",
+					Usage:     "verify the hash chain of the audit log and its rotated files",
+					ArgsUsage: "[FILE...]",
+					Action: func(c *cli.Context) error {
+						if err := s.VerifyAudit(c.Args()); err != nil {
+							return cli.NewExitError(err.Error(), 1)
+						}
+						return nil
+					},
+				},
+			},
+		},
+		{
+			Name:  "gc",
+			Usage: "remove orphaned and expired containers and their state (NOTE:common user have no permission to do this operation)",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "print what would be removed without removing anything",
+				},
+				cli.DurationFlag{
+					Name:  "ttl",
+					Value: socker.DefaultGCTTL,
+					Usage: "remove stopped containers older than the duration",
+				},
+			},
+			Before: func(c *cli.Context) error {
+				if s.CurrentUID != "0" {
+					log.Fatal("You have no permission to do this.")
+				}
+				return nil
+			},
+			Action: func(c *cli.Context) error {
+				err := s.GC(socker.GCOpts{DryRun: c.Bool("dry-run"),
+					TTL: c.Duration("ttl")})
+				if err != nil {
+					return cli.NewExitError(err.Error(), 1)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "daemon",
+			Usage: "serve socker commands over a unix socket (NOTE:common user have no permission to do this operation)",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "socket, s",
+					Value: socker.DefaultDaemonSocket,
+					Usage: "unix socket to listen on",
+				},
+			},
+			Before: func(c *cli.Context) error {
+				if s.CurrentUID != "0" {
+					log.Fatal("You have no permission to do this.")
+				}
+				return nil
+			},
+			Action: func(c *cli.Context) error {
+				err := socker.NewDaemon(s, c.String("socket")).Serve()
 				if err != nil {
-					return cli.NewExitError(err, 1)
+					return cli.NewExitError(err.Error(), 1)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "authz-plugin",
+			Usage: "serve as a Docker authorization plugin enforcing socker policy (NOTE:common user have no permission to do this operation)",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "socket, s",
+					Value: socker.DefaultAuthZSocket,
+					Usage: "unix socket to listen on",
+				},
+				cli.StringFlag{
+					Name:  "config, c",
+					Usage: "images config file",
+				},
+			},
+			Before: func(c *cli.Context) error {
+				if s.CurrentUID != "0" {
+					log.Fatal("You have no permission to do this.")
+				}
+				return nil
+			},
+			Action: func(c *cli.Context) error {
+				err := socker.NewAuthZPlugin(s, c.String("socket"),
+					c.String("config")).Serve()
+				if err != nil {
+					return cli.NewExitError(err.Error(), 1)
 				}
 				return nil
 			},
@@ -130,15 +278,52 @@ func main() {
 
 func appInit(ctx *cli.Context) error {
 	var err error
+	if host != "" && clientCommands[ctx.Args().First()] {
+		client = socker.NewClient(host)
+		return nil
+	}
 	conf := &socker.Config{
 		Verbose:       verbose,
 		EpilogEnabled: epilogEnabled,
 		Insecure:      insecure,
+		BestEffort:    bestEffort,
 	}
 	s, err = socker.New(conf)
 	if err != nil {
 		log.Fatal(fmt.Sprintf("init socker failed: %v", err))
 		os.Exit(2)
 	}
+	if command := commandName(ctx); command != "" {
+		if err := s.Authorize(command); err != nil {
+			return cli.NewExitError(err.Error(), socker.ExitCode(err))
+		}
+	}
+	return nil
+}
+
+// commandName returns the name of the command to run with its subcommand,
+// e.g. "images sync", it is empty for help.
+func commandName(ctx *cli.Context) string {
+	args := ctx.Args()
+	name := args.First()
+	if ctx.App.Command(name) == nil || name == "help" || name == "h" {
+		return ""
+	}
+	if name == "images" && len(args) > 1 && !strings.HasPrefix(args[1], "-") {
+		return name + " " + args[1]
+	}
+	return name
+}
+
+// call runs the command via socker daemon in client mode, otherwise runs it
+// locally by the run function.
+func call(c *cli.Context, run func([]string) error) error {
+	if client != nil {
+		return client.Call(c.Command.Name, c.Args())
+	}
+	err := run(c.Args())
+	if err != nil {
+		return cli.NewExitError(err.Error(), socker.ExitCode(err))
+	}
 	return nil
 }
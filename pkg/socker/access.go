@@ -0,0 +1,80 @@
+// Copyright (c) 2018 China-HPC.
+
+package socker
+
+import (
+	"fmt"
+	"strings"
+
+	suser "github.com/China-HPC/go-socker/pkg/user"
+)
+
+// Access restricts the usage of socker to the members of groups, everyone
+// can use socker if no group is defined.
+type Access struct {
+	// Groups are the groups whose members can use socker.
+	Groups []string `yaml:"groups"`
+	// Commands override Groups for the commands such as "run" and
+	// "images sync", the admin commands are delegated to their groups.
+	Commands map[string][]string `yaml:"commands"`
+	// Message is appended to the denial message, e.g. how to request access.
+	Message string `yaml:"message"`
+}
+
+// groupsOf returns the groups permitted to run the command.
+func (a *Access) groupsOf(command string) []string {
+	if groups, ok := a.Commands[command]; ok {
+		return groups
+	}
+	return a.Groups
+}
+
+// Authorize checks whether current user is permitted to run the command by
+// group membership, root is always permitted.
+func (s *Socker) Authorize(command string) error {
+	if s.CurrentUID == "0" {
+		return nil
+	}
+	groups := s.policy.Access.groupsOf(command)
+	if len(groups) == 0 {
+		return nil
+	}
+	if s.isMemberOfAny(groups) {
+		return nil
+	}
+	msg := fmt.Sprintf("user %s is not permitted to run 'socker %s', membership of group %s is required",
+		s.currentUser, command, strings.Join(groups, " or "))
+	if s.policy.Access.Message != "" {
+		msg += ". " + s.policy.Access.Message
+	}
+	err := fmt.Errorf("%s", msg)
+	s.logger().Warnf("socker command denied: %v", err)
+	s.auditDenial(s.newAuditRecord(command, nil), err)
+	return denied(err)
+}
+
+// IsDelegated reports whether the admin command is delegated to the groups
+// current user is a member of.
+func (s *Socker) IsDelegated(command string) bool {
+	groups, ok := s.policy.Access.Commands[command]
+	return ok && s.isMemberOfAny(groups)
+}
+
+func (s *Socker) isMemberOfAny(groups []string) bool {
+	cred, err := suser.GetUserCredByUID(s.CurrentUID)
+	if err != nil {
+		s.logger().Errorf("get credential of %s failed: %v", s.currentUser, err)
+		return false
+	}
+	for _, name := range groups {
+		g, err := suser.LookupGroup(name)
+		if err != nil {
+			s.logger().Warnf("lookup authorized group %s failed: %v", name, err)
+			continue
+		}
+		if isMemberOfGroup(cred.Groups, g.GID) {
+			return true
+		}
+	}
+	return false
+}
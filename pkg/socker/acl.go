@@ -0,0 +1,302 @@
+// Copyright (c) 2018 China-HPC.
+
+package socker
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// the tags of the entries of POSIX ACLs in the extended attribute.
+	aclUserObj  = 0x01
+	aclUser     = 0x02
+	aclGroupObj = 0x04
+	aclGroup    = 0x08
+	aclMask     = 0x10
+	aclOther    = 0x20
+	// xattrACLAccess holds the access ACL of a file, it starts with the
+	// version followed by the entries.
+	xattrACLAccess  = "system.posix_acl_access"
+	xattrACLVersion = 2
+	xattrACLHeader  = 4
+	xattrACLEntry   = 8
+
+	swapDirName       = "container"
+	permSwapDir       = 0700
+	permLegacySwapDir = 0777
+	permLegacyHome    = 0755
+	permRestoredHome  = 0750
+	// the directory passed to ACL commands as an inherited file descriptor,
+	// so the path can't be replaced by a symlink after it has been checked.
+	aclTargetFd = "/proc/self/fd/3"
+)
+
+// prepareSwapDir creates the swap directory in user's home and grants the
+// remapped container root access to it by POSIX ACLs, and the remapped
+// current user if the container runs as it. The mode of the home directory is
+// only changed to restore the one left by the former versions. It is safe to
+// be called repeatedly.
+func (s *Socker) prepareSwapDir(asUser bool) (string, error) {
+	uid, err := strconv.Atoi(s.CurrentUID)
+	if err != nil {
+		return "", err
+	}
+	gid, err := strconv.Atoi(s.currentGID)
+	if err != nil {
+		return "", err
+	}
+	home, err := os.OpenFile(s.homeDir, os.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		return "", err
+	}
+	defer home.Close()
+	swapDir := path.Join(s.homeDir, swapDirName)
+	if err := os.Mkdir(swapDir, permSwapDir); err != nil && !os.IsExist(err) {
+		return "", err
+	}
+	swap, err := os.OpenFile(swapDir,
+		os.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return "", fmt.Errorf("swap directory %s must be a directory: %v",
+			swapDir, err)
+	}
+	defer swap.Close()
+	info, err := swap.Stat()
+	if err != nil {
+		return "", err
+	}
+	// the directory is created by root, or by the former versions of socker.
+	stat := info.Sys().(*syscall.Stat_t)
+	if int(stat.Uid) != uid && stat.Uid != 0 {
+		return "", fmt.Errorf("swap directory %s is not owned by %s",
+			swapDir, s.currentUser)
+	}
+	if int(stat.Uid) != uid || int(stat.Gid) != gid {
+		if err := swap.Chown(uid, gid); err != nil {
+			return "", err
+		}
+	}
+	// the former versions of socker left the swap directory 0777 and the
+	// home directory 0755, the home directory was restored to 0750 by them
+	// when the container exited.
+	if info.Mode().Perm() == permLegacySwapDir {
+		if homeInfo, err := home.Stat(); err == nil && homeInfo.Mode().Perm() == permLegacyHome {
+			s.logger().Infof("restore mode of %s to %o", s.homeDir, permRestoredHome)
+			if err := home.Chmod(permRestoredHome); err != nil {
+				return "", err
+			}
+		}
+	}
+	acl, err := getACL(swap)
+	if err != nil {
+		return "", err
+	}
+	// the group bits are the mask of ACL, which must not be cleared.
+	mode := os.FileMode(permSwapDir)
+	if hasExtendedACL(acl) {
+		mode |= info.Mode().Perm() & 0070
+	}
+	if info.Mode().Perm() != mode {
+		if err := swap.Chmod(mode); err != nil {
+			return "", err
+		}
+	}
+	if s.remap == nil {
+		// userns-remap is waived, the container root is the host root.
+		return swapDir, nil
+	}
+	entries, err := s.remapACL("--x", uid, gid, asUser, false)
+	if err != nil {
+		return "", err
+	}
+	if err := ensureACL(home, entries...); err != nil {
+		return "", err
+	}
+	entries, err = s.remapACL("rwx", uid, gid, asUser, true)
+	if err != nil {
+		return "", err
+	}
+	if err := ensureACL(swap, entries...); err != nil {
+		return "", err
+	}
+	return swapDir, nil
+}
+
+// remapACL returns the ACL entries granting the rights to the host ids of the
+// container, which are the remapped root, and the remapped current user and
+// group if the container runs as current user. The default entries are added
+// for inherited, they keep the files created by the container accessible to
+// current user.
+func (s *Socker) remapACL(rights string, uid, gid int, asUser, inherited bool) ([]string, error) {
+	entries := []string{fmt.Sprintf("user:%d:%s", s.remap.UIDs.Start, rights)}
+	if asUser {
+		hostUID, hostGID, err := s.remap.hostIDs(uid, gid)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, fmt.Sprintf("user:%d:%s", hostUID, rights),
+			fmt.Sprintf("group:%d:%s", hostGID, rights))
+	}
+	if !inherited {
+		return entries, nil
+	}
+	defaults := make([]string, 0, len(entries)+1)
+	for _, entry := range entries {
+		defaults = append(defaults, "default:"+entry)
+	}
+	defaults = append(defaults, fmt.Sprintf("default:user:%d:%s", uid, rights))
+	return append(entries, defaults...), nil
+}
+
+// aclCommand creates the ACL command on the directory passed as an inherited
+// file descriptor, the environment of user is not inherited.
+func aclCommand(name string, dir *os.File, args ...string) (*exec.Cmd, error) {
+	cmd, err := trustedCommand(name, append(args, aclTargetFd)...)
+	if err != nil {
+		return nil, fmt.Errorf("%s not found, make sure the acl package is installed", name)
+	}
+	cmd.ExtraFiles = []*os.File{dir}
+	return cmd, nil
+}
+
+// getACL returns the effective rights of the ACL entries of the directory,
+// e.g. "user:1000" is "rwx".
+func getACL(dir *os.File) (map[string]string, error) {
+	cmd, err := aclCommand(cmdGetfacl, dir, "--numeric", "--omit-header",
+		"--absolute-names")
+	if err != nil {
+		return nil, err
+	}
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		log.Errorf("get ACL of %s failed: %v:%s", dir.Name(), err, output)
+		return nil, err
+	}
+	return parseACL(string(output)), nil
+}
+
+// parseACL parses the output of getfacl, the effective rights are appended
+// as comment if they are masked, e.g. "user:1000:rwx #effective:r-x".
+func parseACL(output string) map[string]string {
+	acl := make(map[string]string)
+	for _, line := range strings.Split(output, lineBrk) {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		i := strings.LastIndex(fields[0], sepColon)
+		if i < 0 {
+			continue
+		}
+		key, perms := fields[0][:i], fields[0][i+1:]
+		for _, f := range fields[1:] {
+			if strings.HasPrefix(f, "#effective:") {
+				perms = strings.TrimPrefix(f, "#effective:")
+			}
+		}
+		acl[key] = perms
+	}
+	return acl
+}
+
+// hasExtendedACL reports whether the ACL has entries besides the mode bits,
+// the group bits of the mode are the mask then.
+func hasExtendedACL(acl map[string]string) bool {
+	_, ok := acl["mask:"]
+	return ok
+}
+
+// ensureACL adds the ACL entries to the directory if they are missing or
+// masked, the mask is recalculated by setfacl to grant them.
+func ensureACL(dir *os.File, entries ...string) error {
+	acl, err := getACL(dir)
+	if err != nil {
+		return err
+	}
+	var missing []string
+	for _, entry := range entries {
+		i := strings.LastIndex(entry, sepColon)
+		if acl[entry[:i]] != entry[i+1:] {
+			missing = append(missing, entry)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	log.Debugf("set ACL of %s: %v", dir.Name(), missing)
+	cmd, err := aclCommand(cmdSetfacl, dir, "-m", strings.Join(missing, ","))
+	if err != nil {
+		return err
+	}
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		log.Errorf("set ACL of %s failed: %v:%s", dir.Name(), err, output)
+		return err
+	}
+	return nil
+}
+
+// aclEntry is an entry of the POSIX ACL of a file.
+type aclEntry struct {
+	Tag  uint16
+	Perm uint32
+	ID   uint32
+}
+
+// fdPath returns the path of the file descriptor, the ACL of a file opened
+// with O_PATH can only be read through it.
+func fdPath(fd int) string {
+	return fmt.Sprintf("/proc/self/fd/%d", fd)
+}
+
+// readACL reads the access ACL of the file, the symlink is followed only if
+// follow is set. It returns nil if the file has no ACL, or the file system
+// doesn't support ACLs.
+func readACL(p string, follow bool) ([]aclEntry, error) {
+	getxattr := unix.Lgetxattr
+	if follow {
+		getxattr = unix.Getxattr
+	}
+	buf := make([]byte, xattrACLHeader+32*xattrACLEntry)
+	for {
+		n, err := getxattr(p, xattrACLAccess, buf)
+		switch err {
+		case nil:
+			return parseACLXattr(buf[:n])
+		case unix.ENODATA, unix.EOPNOTSUPP:
+			return nil, nil
+		case unix.ERANGE:
+			buf = make([]byte, 2*len(buf))
+		default:
+			return nil, fmt.Errorf("read ACL failed: %v", err)
+		}
+	}
+}
+
+// parseACLXattr parses the ACL in the format of the extended attribute, the
+// fields are little endian.
+func parseACLXattr(data []byte) ([]aclEntry, error) {
+	if len(data) < xattrACLHeader || (len(data)-xattrACLHeader)%xattrACLEntry != 0 ||
+		binary.LittleEndian.Uint32(data) != xattrACLVersion {
+		return nil, fmt.Errorf("invalid ACL")
+	}
+	var acl []aclEntry
+	for i := xattrACLHeader; i < len(data); i += xattrACLEntry {
+		acl = append(acl, aclEntry{
+			Tag:  binary.LittleEndian.Uint16(data[i:]),
+			Perm: uint32(binary.LittleEndian.Uint16(data[i+2:])),
+			ID:   binary.LittleEndian.Uint32(data[i+4:]),
+		})
+	}
+	return acl, nil
+}
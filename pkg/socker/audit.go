@@ -0,0 +1,375 @@
+// Copyright (c) 2018 China-HPC.
+
+package socker
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/China-HPC/go-socker/pkg/su"
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	dftAuditFile    = "/var/log/socker/audit.log"
+	dftAuditMaxSize = "64m"
+	permAuditDir    = 0700
+	permAuditFile   = 0600
+	// the suffix of rotated audit logs, they are sorted by name in time order.
+	layoutAuditRotate = "20060102T150405.000000000Z"
+	prefixAuditHash   = "sha256:"
+	maxAuditRecord    = 1 << 20
+	envSlurmStepID    = "SLURM_STEP_ID"
+
+	decisionAllow = "allow"
+	decisionDeny  = "deny"
+
+	maskedValue = "***"
+)
+
+// envFlags are the flags whose values may contain secrets, they are masked
+// in the audit log.
+var envFlags = map[string]bool{"-e": true, "--env": true}
+
+var mountFlags = map[string]bool{
+	"-v": true, "--volume": true, "--mount": true, "--tmpfs": true,
+}
+
+// AuditRecord is a line of the audit log, it records who ran what image with
+// which mounts in which job.
+type AuditRecord struct {
+	Time      string   `json:"ts"`
+	UID       string   `json:"uid"`
+	User      string   `json:"user"`
+	Host      string   `json:"host"`
+	JobID     string   `json:"job_id,omitempty"`
+	StepID    string   `json:"step_id,omitempty"`
+	Command   string   `json:"command"`
+	Container string   `json:"container,omitempty"`
+	Image     string   `json:"image,omitempty"`
+	Digest    string   `json:"digest,omitempty"`
+	Argv      []string `json:"argv,omitempty"`
+	Mounts    []string `json:"mounts,omitempty"`
+	Decision  string   `json:"decision"`
+	Reason    string   `json:"reason,omitempty"`
+	// PrevHash is the hash of the previous record, it chains the records
+	// across the rotated files so edits and gaps are detected.
+	PrevHash string `json:"prev_hash"`
+}
+
+// newAuditRecord creates an audit record of the command run by current user.
+func (s *Socker) newAuditRecord(command string, argv []string) *AuditRecord {
+	host, _ := os.Hostname()
+	return &AuditRecord{
+		UID:     s.CurrentUID,
+		User:    s.currentUser,
+		Host:    host,
+		JobID:   s.slurmJobID,
+		StepID:  lookupEnv(s.environ, envSlurmStepID),
+		Command: command,
+		Argv:    sanitizeArgv(argv),
+	}
+}
+
+// audit appends the record with the decision to the audit log, reason is
+// the error of denial.
+func (s *Socker) audit(rec *AuditRecord, decision string, reason error) error {
+	rec.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	rec.Decision = decision
+	if reason != nil {
+		rec.Reason = reason.Error()
+	}
+	file, maxSize := dftAuditFile, dftAuditMaxSize
+	if s.policy != nil {
+		file, maxSize = s.policy.AuditFile, s.policy.AuditMaxSize
+	}
+	if file == "" {
+		// the audit log is disabled by site policy.
+		return nil
+	}
+	var max int64
+	if maxSize != "" {
+		var err error
+		if max, err = parseSize(maxSize); err != nil {
+			return err
+		}
+	}
+	err := appendAuditRecord(file, max, rec)
+	if err != nil {
+		s.logger().Errorf("write audit log %s failed: %v", file, err)
+	}
+	return err
+}
+
+// auditDenial records the denial, the failure of writing is only logged as
+// the command is denied anyway.
+func (s *Socker) auditDenial(rec *AuditRecord, reason error) {
+	s.audit(rec, decisionDeny, reason)
+}
+
+// appendAuditRecord appends the record as a JSON line to the root owned
+// audit log with the hash of the last record, the file is rotated when it
+// reaches maxSize and the chain is carried to the new file. The file is
+// locked so the records of concurrent runs are not interleaved.
+func appendAuditRecord(file string, maxSize int64, rec *AuditRecord) error {
+	if err := os.MkdirAll(path.Dir(file), permAuditDir); err != nil {
+		return err
+	}
+	f, err := openAuditFile(file)
+	if err != nil {
+		return err
+	}
+	defer func() { f.Close() }()
+	last, size, err := lastAuditRecord(f)
+	if err != nil {
+		return err
+	}
+	if maxSize > 0 && size >= maxSize {
+		rotated := fmt.Sprintf("%s.%s", file, time.Now().UTC().Format(layoutAuditRotate))
+		if err := os.Rename(file, rotated); err != nil {
+			return err
+		}
+		log.Infof("audit log rotated to %s", rotated)
+		f.Close()
+		if f, err = openAuditFile(file); err != nil {
+			return err
+		}
+		// the file may have been written by others after rotation.
+		current, _, err := lastAuditRecord(f)
+		if err != nil {
+			return err
+		}
+		if current != nil {
+			last = current
+		}
+	}
+	rec.PrevHash = hashAuditRecord(last)
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// openAuditFile opens the audit log for appending and locks it, the lock is
+// released when the file is closed.
+func openAuditFile(file string) (*os.File, error) {
+	for {
+		fd, err := unix.Open(file, unix.O_RDWR|unix.O_APPEND|unix.O_CREAT|
+			unix.O_NOFOLLOW|unix.O_CLOEXEC, permAuditFile)
+		if err != nil {
+			return nil, err
+		}
+		f := os.NewFile(uintptr(fd), file)
+		stat := &unix.Stat_t{}
+		if err := unix.Fstat(fd, stat); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if stat.Mode&unix.S_IFMT != unix.S_IFREG || stat.Uid != 0 || stat.Mode&0022 != 0 {
+			f.Close()
+			return nil, fmt.Errorf("audit log %s must be a regular file owned and writable only by root", file)
+		}
+		if err := unix.Flock(fd, unix.LOCK_EX); err != nil {
+			f.Close()
+			return nil, err
+		}
+		// the file is rotated by others while waiting for the lock.
+		current := &unix.Stat_t{}
+		err = unix.Lstat(file, current)
+		if err == nil && current.Ino == stat.Ino && current.Dev == stat.Dev {
+			return f, nil
+		}
+		f.Close()
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+}
+
+// lastAuditRecord returns the last record and the size of the audit log.
+func lastAuditRecord(f *os.File) ([]byte, int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	size := info.Size()
+	var buf []byte
+	for off := size; off > 0; {
+		n := int64(4096)
+		if n > off {
+			n = off
+		}
+		off -= n
+		chunk := make([]byte, n)
+		if _, err := f.ReadAt(chunk, off); err != nil {
+			return nil, 0, err
+		}
+		buf = append(chunk, buf...)
+		record := bytes.TrimRight(buf, "\n")
+		if i := bytes.LastIndexByte(record, '\n'); i >= 0 {
+			return record[i+1:], size, nil
+		}
+		if len(buf) > maxAuditRecord {
+			return nil, 0, fmt.Errorf("last record of audit log %s is too long", f.Name())
+		}
+	}
+	if record := bytes.TrimRight(buf, "\n"); len(record) > 0 {
+		return record, size, nil
+	}
+	return nil, size, nil
+}
+
+// hashAuditRecord returns the hash of the record line, it is empty for the
+// first record of the chain.
+func hashAuditRecord(record []byte) string {
+	if record == nil {
+		return ""
+	}
+	sum := sha256.Sum256(record)
+	return prefixAuditHash + hex.EncodeToString(sum[:])
+}
+
+// auditFiles returns the rotated files and the audit log in time order.
+func auditFiles(file string) ([]string, error) {
+	rotated, err := filepath.Glob(file + ".*")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(rotated)
+	return append(rotated, file), nil
+}
+
+// VerifyAudit walks the hash chain of the audit logs in order and reports
+// the gaps and edits, the rotated files of the audit log defined by site
+// policy are verified if no file is specified.
+func (s *Socker) VerifyAudit(files []string) error {
+	if len(files) == 0 {
+		var err error
+		if files, err = auditFiles(s.policy.AuditFile); err != nil {
+			return err
+		}
+	}
+	var last []byte
+	records, problems := 0, 0
+	report := func(file string, line int, format string, args ...interface{}) {
+		problems++
+		fmt.Fprintf(s.streams.Stdout, "%s:%d: %s\n", file, line,
+			fmt.Sprintf(format, args...))
+	}
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 4096), maxAuditRecord)
+		for line := 1; scanner.Scan(); line++ {
+			record := append([]byte(nil), scanner.Bytes()...)
+			rec := &AuditRecord{}
+			if err := json.Unmarshal(record, rec); err != nil {
+				report(file, line, "malformed record: %v", err)
+			} else if records == 0 && rec.PrevHash != "" {
+				fmt.Fprintf(s.streams.Stdout,
+					"%s:%d: chain starts after a record which is not available\n",
+					file, line)
+			} else if records > 0 && rec.PrevHash != hashAuditRecord(last) {
+				report(file, line, "hash of previous record mismatched, the previous record is edited or records are missing")
+			}
+			records++
+			last = record
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("read %s failed: %v", file, err)
+		}
+	}
+	fmt.Fprintf(s.streams.Stdout, "%d records verified, %d problems found\n",
+		records, problems)
+	if problems > 0 {
+		return fmt.Errorf("audit log is tampered")
+	}
+	return nil
+}
+
+// sanitizeArgv masks the values of environment variables in argv.
+func sanitizeArgv(argv []string) []string {
+	sanitized := make([]string, 0, len(argv))
+	maskNext := false
+	for _, arg := range argv {
+		switch {
+		case maskNext:
+			arg = maskEnv(arg)
+			maskNext = false
+		case envFlags[arg]:
+			maskNext = true
+		case strings.HasPrefix(arg, "--env="):
+			arg = "--env=" + maskEnv(strings.TrimPrefix(arg, "--env="))
+		case strings.HasPrefix(arg, "-e") && len(arg) > 2 && !strings.HasPrefix(arg, "--"):
+			arg = "-e" + maskEnv(strings.TrimPrefix(arg, "-e"))
+		case arg == "--":
+			// the arguments of container command are kept.
+			sanitized = append(sanitized, argv[len(sanitized):]...)
+			return sanitized
+		}
+		sanitized = append(sanitized, arg)
+	}
+	return sanitized
+}
+
+// maskEnv masks the value of KEY=VALUE.
+func maskEnv(env string) string {
+	if i := strings.IndexByte(env, '='); i >= 0 {
+		return env[:i+1] + maskedValue
+	}
+	return env
+}
+
+// mountsOf returns the mounts in docker run args.
+func mountsOf(args []string) []string {
+	var mounts []string
+	for i := 0; i < len(args); i++ {
+		switch flag := strings.SplitN(args[i], "=", 2); {
+		case len(flag) == 2 && mountFlags[flag[0]]:
+			mounts = append(mounts, flag[1])
+		case mountFlags[args[i]] && i+1 < len(args):
+			mounts = append(mounts, args[i+1])
+			i++
+		}
+	}
+	return mounts
+}
+
+// imageID returns the ID of the local image.
+func (s *Socker) imageID(image string) (string, error) {
+	output, err := su.Output(s.dockerUID, cmdDocker, "image", "inspect",
+		"--format", "{{.Id}}", image)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// imageDigest returns the content addressable ID and repo digests of image.
+func (s *Socker) imageDigest(image string) string {
+	output, err := su.Output(s.dockerUID, cmdDocker, "image", "inspect",
+		"--format", "{{.Id}} {{range .RepoDigests}}{{.}} {{end}}", image)
+	if err != nil {
+		s.logger().Debugf("inspect image %s failed: %v", image, err)
+		return ""
+	}
+	return strings.TrimSpace(string(output))
+}
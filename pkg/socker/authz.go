@@ -0,0 +1,567 @@
+// Copyright (c) 2018 China-HPC.
+
+package socker
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	suser "github.com/China-HPC/go-socker/pkg/user"
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// DefaultAuthZSocket is the socket where Docker discovers the socker
+	// authorization plugin named "socker-authz".
+	DefaultAuthZSocket = "/run/docker/plugins/socker-authz.sock"
+	permAuthZSocket    = 0600
+
+	contentTypePlugin = "application/vnd.docker.plugins.v1+json"
+	nsHost            = "host"
+
+	dockerSocket = "/var/run/docker.sock"
+	// headerAuthZSecret carries the secret of the plugin in its own requests
+	// to Docker, they are authorized by the plugin as well.
+	headerAuthZSecret = "X-Socker-Authz"
+	inspectTimeout    = 10 * time.Second
+)
+
+var (
+	apiVersionPrefix = regexp.MustCompile(`^/v[0-9.]+`)
+	containerExecURI = regexp.MustCompile(`^/containers/[^/]+/exec$`)
+	// containerURI matches the requests on a container, e.g. logs, archive
+	// and stop, the id can be the name or a prefix of the ID.
+	containerURI = regexp.MustCompile(`^/containers/([^/]+)(/|$)`)
+	// the requests on the collection of containers rather than one.
+	containerCollections = map[string]bool{"create": true, "json": true, "prune": true}
+	imageTagURI          = regexp.MustCompile(`^/images/.+/tag$`)
+	// requests create workloads outside of the container create API, they
+	// can't be checked by socker policy.
+	deniedURIPrefixes = []string{"/build", "/plugins", "/services", "/swarm"}
+	// requests create images which could take the names of the permitted
+	// images, they are permitted only for root.
+	imageURIPrefixes = []string{"/images/create", "/images/load", "/commit"}
+	// requests remove the containers of all users.
+	rootURIPrefixes = []string{"/containers/prune"}
+)
+
+// AuthZPlugin implements the Docker authorization plugin protocol, it applies
+// the socker run policy to the raw Docker API requests.
+type AuthZPlugin struct {
+	s           *Socker
+	socketPath  string
+	imageConfig string
+	// imageID resolves the image name to the ID of the local image.
+	imageID func(name string) (string, error)
+	// containerOwner returns the owner label of the container.
+	containerOwner func(id string) (string, error)
+	// secret marks the requests of the plugin itself.
+	secret string
+}
+
+// authZRequest represents the request Docker sends to authorization plugin.
+type authZRequest struct {
+	User            string            `json:"User,omitempty"`
+	UserAuthNMethod string            `json:"UserAuthNMethod,omitempty"`
+	RequestMethod   string            `json:"RequestMethod,omitempty"`
+	RequestURI      string            `json:"RequestURI,omitempty"`
+	RequestBody     []byte            `json:"RequestBody,omitempty"`
+	RequestHeaders  map[string]string `json:"RequestHeaders,omitempty"`
+}
+
+// authZResponse represents the response of authorization plugin.
+type authZResponse struct {
+	Allow bool   `json:"Allow"`
+	Msg   string `json:"Msg,omitempty"`
+	Err   string `json:"Err,omitempty"`
+}
+
+// containerCreateBody is the part of container create request checked by
+// socker policy.
+type containerCreateBody struct {
+	Image      string
+	User       string
+	Labels     map[string]string
+	HostConfig struct {
+		Binds  []string
+		Mounts []struct {
+			Type     string
+			Source   string
+			Target   string
+			ReadOnly bool
+		}
+		Privileged   bool
+		CapAdd       []string
+		Devices      []json.RawMessage
+		SecurityOpt  []string
+		VolumesFrom  []string
+		NetworkMode  string
+		PidMode      string
+		IpcMode      string
+		UsernsMode   string
+		UTSMode      string
+		CgroupParent string
+		Runtime      string
+		GroupAdd     []string
+		// the paths are unmasked if they are set, even to empty.
+		MaskedPaths       *[]string
+		ReadonlyPaths     *[]string
+		DeviceCgroupRules []string
+		Sysctls           map[string]string
+	}
+}
+
+// AuthZPolicy defines how the authorization plugin treats the requests.
+type AuthZPolicy struct {
+	// AllowUnauthenticated permits creating containers by the requests
+	// without an authenticated user, e.g. Docker without TLS authentication,
+	// they can run as any regular user.
+	AllowUnauthenticated bool `yaml:"allow_unauthenticated"`
+}
+
+// volumeCreateBody is the part of volume create request checked by socker
+// policy.
+type volumeCreateBody struct {
+	Name       string
+	DriverOpts map[string]string
+	Labels     map[string]string
+}
+
+// execCreateBody is the part of exec create request checked by socker policy.
+type execCreateBody struct {
+	User       string
+	Privileged bool
+}
+
+// NewAuthZPlugin creates an authorization plugin listens on socketPath, the
+// images are permitted only if they are defined in imageConfig.
+func NewAuthZPlugin(s *Socker, socketPath, imageConfig string) *AuthZPlugin {
+	if socketPath == "" {
+		socketPath = DefaultAuthZSocket
+	}
+	if imageConfig == "" {
+		imageConfig = dftImageConfigFile
+	}
+	p := &AuthZPlugin{
+		s:           s,
+		socketPath:  socketPath,
+		imageConfig: imageConfig,
+		imageID:     s.imageID,
+	}
+	p.containerOwner = p.inspectOwner
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		log.Errorf("generate secret of authz plugin failed: %v", err)
+	} else {
+		p.secret = hex.EncodeToString(secret)
+	}
+	return p
+}
+
+// Serve serves the authorization requests from Docker daemon.
+func (p *AuthZPlugin) Serve() error {
+	if err := os.Remove(p.socketPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove stale socket failed: %v", err)
+	}
+	l, err := net.Listen("unix", p.socketPath)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	if err := os.Chmod(p.socketPath, permAuthZSocket); err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/Plugin.Activate", func(w http.ResponseWriter, r *http.Request) {
+		writePluginResponse(w, map[string][]string{"Implements": {"authz"}})
+	})
+	mux.HandleFunc("/AuthZPlugin.AuthZReq", p.handleRequest)
+	mux.HandleFunc("/AuthZPlugin.AuthZRes", func(w http.ResponseWriter, r *http.Request) {
+		writePluginResponse(w, &authZResponse{Allow: true})
+	})
+	log.Infof("socker authz plugin is listening on %s", p.socketPath)
+	return http.Serve(l, mux)
+}
+
+func (p *AuthZPlugin) handleRequest(w http.ResponseWriter, r *http.Request) {
+	req := &authZRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		writePluginResponse(w, &authZResponse{Err: err.Error()})
+		return
+	}
+	if err := p.authorize(req); err != nil {
+		log.Infof("deny %s %s of user %q: %v", req.RequestMethod,
+			req.RequestURI, req.User, err)
+		writePluginResponse(w, &authZResponse{Msg: err.Error()})
+		return
+	}
+	writePluginResponse(w, &authZResponse{Allow: true})
+}
+
+func writePluginResponse(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", contentTypePlugin)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("write plugin response failed: %v", err)
+	}
+}
+
+// authorize checks the Docker API request against socker policy.
+func (p *AuthZPlugin) authorize(req *authZRequest) error {
+	uri := req.RequestURI
+	if i := strings.IndexByte(uri, '?'); i >= 0 {
+		uri = uri[:i]
+	}
+	uri = apiVersionPrefix.ReplaceAllString(uri, "")
+	if p.isOwnRequest(req) {
+		return nil
+	}
+	// every request on a container is checked, including reading its logs
+	// and copying files from it.
+	if m := containerURI.FindStringSubmatch(uri); m != nil && !containerCollections[m[1]] {
+		if err := p.checkContainerOwner(req.User, m[1]); err != nil {
+			return err
+		}
+	}
+	if req.RequestMethod != http.MethodPost {
+		return nil
+	}
+	for _, prefix := range deniedURIPrefixes {
+		if strings.HasPrefix(uri, prefix) {
+			return fmt.Errorf("%s is not permitted by socker", prefix)
+		}
+	}
+	if req.User != "root" {
+		for _, prefix := range imageURIPrefixes {
+			if strings.HasPrefix(uri, prefix) {
+				return fmt.Errorf("%s is only permitted for root", prefix)
+			}
+		}
+		if imageTagURI.MatchString(uri) {
+			return fmt.Errorf("tagging images is only permitted for root")
+		}
+		for _, prefix := range rootURIPrefixes {
+			if strings.HasPrefix(uri, prefix) {
+				return fmt.Errorf("%s is only permitted for root", prefix)
+			}
+		}
+	}
+	switch {
+	case uri == "/containers/create":
+		body := &containerCreateBody{}
+		if err := json.Unmarshal(req.RequestBody, body); err != nil {
+			return fmt.Errorf("decode container create request failed: %v", err)
+		}
+		return p.authorizeCreate(req.User, body)
+	case uri == "/volumes/create":
+		body := &volumeCreateBody{}
+		if err := json.Unmarshal(req.RequestBody, body); err != nil {
+			return fmt.Errorf("decode volume create request failed: %v", err)
+		}
+		return authorizeVolumeCreate(body)
+	case containerExecURI.MatchString(uri):
+		body := &execCreateBody{}
+		if err := json.Unmarshal(req.RequestBody, body); err != nil {
+			return fmt.Errorf("decode exec create request failed: %v", err)
+		}
+		if body.Privileged {
+			return fmt.Errorf("privileged exec is not permitted")
+		}
+		// the exec runs as the user of image otherwise, which may be root.
+		if body.User == "" {
+			return fmt.Errorf("exec must run with --user of a regular user")
+		}
+		_, err := p.checkContainerUser(req.User, body.User)
+		return err
+	}
+	return nil
+}
+
+func (p *AuthZPlugin) authorizeCreate(authUser string, body *containerCreateBody) error {
+	if err := p.isImagePermit(body.Image); err != nil {
+		return err
+	}
+	uid, err := p.checkContainerUser(authUser, body.User)
+	if err != nil {
+		return err
+	}
+	// the owner label can't be added by the plugin, it is required.
+	if body.Labels[labelOwner] != strconv.Itoa(uid) {
+		return fmt.Errorf("container must be labeled with %s=%d", labelOwner, uid)
+	}
+	host := body.HostConfig
+	if host.Privileged {
+		return fmt.Errorf("privileged container is not permitted")
+	}
+	if err := p.s.isCapAddPermit(host.CapAdd); err != nil {
+		return err
+	}
+	if len(host.Devices) != 0 || len(host.DeviceCgroupRules) != 0 {
+		return fmt.Errorf("adding devices is not permitted")
+	}
+	if len(host.GroupAdd) != 0 {
+		return fmt.Errorf("adding groups is not permitted")
+	}
+	if host.MaskedPaths != nil || host.ReadonlyPaths != nil {
+		return fmt.Errorf("changing the masked and read-only paths is not permitted")
+	}
+	if len(host.Sysctls) != 0 {
+		return fmt.Errorf("sysctls are not permitted")
+	}
+	// only the option of the security baseline can be set by users.
+	for _, opt := range host.SecurityOpt {
+		if !isNoNewPrivileges(opt) {
+			return fmt.Errorf("security option %s is not permitted", opt)
+		}
+	}
+	if len(host.VolumesFrom) != 0 {
+		return fmt.Errorf("mounting volumes from other containers is not permitted")
+	}
+	if host.CgroupParent != "" {
+		return fmt.Errorf("cgroup parent is not permitted")
+	}
+	if err := p.s.isRuntimePermit(host.Runtime); err != nil {
+		return err
+	}
+	// joining the namespaces of other containers is refused, they may belong
+	// to other users.
+	if strings.HasPrefix(host.NetworkMode, "container:") {
+		return fmt.Errorf("network mode %s is not permitted", host.NetworkMode)
+	}
+	for name, mode := range map[string]string{
+		"PID":  host.PidMode,
+		"IPC":  host.IpcMode,
+		"user": host.UsernsMode,
+		"UTS":  host.UTSMode,
+	} {
+		if mode == nsHost || strings.HasPrefix(mode, "container:") {
+			return fmt.Errorf("%s namespace %s is not permitted", name, mode)
+		}
+	}
+	opts := &Opts{Volumes: host.Binds}
+	for _, m := range host.Mounts {
+		if m.Type != "bind" {
+			return fmt.Errorf("mount type %s is not permitted", m.Type)
+		}
+		spec := fmt.Sprintf("type=bind,source=%s,target=%s", m.Source, m.Target)
+		if m.ReadOnly {
+			spec += ",readonly"
+		}
+		opts.Mounts = append(opts.Mounts, spec)
+	}
+	if len(opts.Volumes) == 0 && len(opts.Mounts) == 0 {
+		return nil
+	}
+	// the named volumes are prefixed with the owner by socker run, the
+	// request can't be rewritten to them.
+	for _, vol := range opts.Volumes {
+		if !filepath.IsAbs(strings.SplitN(vol, sepColon, 2)[0]) {
+			return fmt.Errorf("volume %s: named volume is not permitted", vol)
+		}
+	}
+	// the bind mounts are checked against the permissions of the user as
+	// socker run does, they can't be attributed to a user without one.
+	if authUser == "" {
+		return fmt.Errorf("bind mounts are not permitted without an authenticated user")
+	}
+	u, err := suser.LookupUser(authUser)
+	if err != nil {
+		return fmt.Errorf("lookup user %s failed: %v", authUser, err)
+	}
+	caller := *p.s
+	if err := caller.setCaller(u, nil); err != nil {
+		return err
+	}
+	err = caller.checkMounts(opts)
+	caller.releaseBinds()
+	return err
+}
+
+// isOwnRequest reports whether the request is sent by the plugin itself.
+func (p *AuthZPlugin) isOwnRequest(req *authZRequest) bool {
+	if p.secret == "" {
+		return false
+	}
+	for key, value := range req.RequestHeaders {
+		if strings.EqualFold(key, headerAuthZSecret) {
+			return subtle.ConstantTimeCompare([]byte(value), []byte(p.secret)) == 1
+		}
+	}
+	return false
+}
+
+// checkContainerOwner ensures the container is owned by the authenticated user
+// of the request, root can access all containers. The requests without one
+// are denied unless permitted by site policy.
+func (p *AuthZPlugin) checkContainerOwner(authUser, id string) error {
+	if authUser == "" {
+		if p.s.policy.AuthZ.AllowUnauthenticated {
+			return nil
+		}
+		return fmt.Errorf("the request is not authenticated")
+	}
+	if authUser == "root" {
+		return nil
+	}
+	u, err := suser.LookupUser(authUser)
+	if err != nil {
+		return fmt.Errorf("lookup user %s failed: %v", authUser, err)
+	}
+	owner, err := p.containerOwner(id)
+	if err != nil {
+		return fmt.Errorf("inspect container %s failed: %v", id, err)
+	}
+	if owner != strconv.Itoa(u.UID) {
+		return fmt.Errorf("container %s is not owned by %s", id, authUser)
+	}
+	return nil
+}
+
+// inspectOwner inspects the owner label of the container over the Docker
+// socket, the request carries the secret so it is not checked again.
+func (p *AuthZPlugin) inspectOwner(id string) (string, error) {
+	client := &http.Client{
+		Timeout: inspectTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", dockerSocket)
+			},
+		},
+	}
+	req, err := http.NewRequest(http.MethodGet,
+		"http://docker/containers/"+url.PathEscape(id)+"/json", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set(headerAuthZSecret, p.secret)
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	state := &containerState{}
+	if err := json.NewDecoder(resp.Body).Decode(state); err != nil {
+		return "", err
+	}
+	return state.Config.Labels[labelOwner], nil
+}
+
+// authorizeVolumeCreate denies the volumes which could be taken as the named
+// volumes of socker users, and the driver options which bind host paths.
+func authorizeVolumeCreate(body *volumeCreateBody) error {
+	if len(body.DriverOpts) != 0 {
+		return fmt.Errorf("volume driver options are not permitted")
+	}
+	if strings.HasPrefix(body.Name, namedVolumePrefix) {
+		return fmt.Errorf("volume name %s is reserved by socker", body.Name)
+	}
+	for label := range body.Labels {
+		if strings.HasPrefix(label, labelPrefix) {
+			return fmt.Errorf("volume label %s is reserved by socker", label)
+		}
+	}
+	return nil
+}
+
+func isNoNewPrivileges(opt string) bool {
+	switch opt {
+	case "no-new-privileges", "no-new-privileges:true", "no-new-privileges=true":
+		return true
+	}
+	return false
+}
+
+// isImagePermit checks whether the image is defined in socker image config,
+// the image can be referred by name or ID. The name must resolve to the ID
+// in the config, so an image retagged with the name is refused.
+func (p *AuthZPlugin) isImagePermit(name string) error {
+	images, err := loadImages(p.imageConfig)
+	if err != nil {
+		return err
+	}
+	image, ok := findImage(images, name)
+	if !ok {
+		return fmt.Errorf("image %s is not permitted", name)
+	}
+	id, err := p.imageID(name)
+	if err != nil {
+		return fmt.Errorf("resolve image %s failed: %v", name, err)
+	}
+	want := strings.TrimPrefix(image.ID, "sha256:")
+	if want == "" || !strings.HasPrefix(strings.TrimPrefix(id, "sha256:"), want) {
+		return fmt.Errorf("image %s is not the permitted image %s", name, image.ID)
+	}
+	return nil
+}
+
+// checkContainerUser ensures the container runs as a non-root user and group,
+// the container must run as the authenticated user of the request, the
+// requests without one are denied unless permitted by site policy. It returns
+// the uid the container runs as.
+func (p *AuthZPlugin) checkContainerUser(authUser, containerUser string) (int, error) {
+	fields := strings.SplitN(containerUser, sepColon, 2)
+	uid, err := resolveID(fields[0], func(name string) (int, error) {
+		u, err := suser.LookupUser(name)
+		if err != nil {
+			return 0, err
+		}
+		return u.UID, nil
+	})
+	if err != nil || uid == 0 {
+		return 0, fmt.Errorf("container must run with --user of a regular user")
+	}
+	if len(fields) == 2 {
+		gid, err := resolveID(fields[1], func(name string) (int, error) {
+			g, err := suser.LookupGroup(name)
+			if err != nil {
+				return 0, err
+			}
+			return g.GID, nil
+		})
+		if err != nil || gid == 0 {
+			return 0, fmt.Errorf("container must run with a regular group")
+		}
+	}
+	if authUser == "" {
+		if p.s.policy.AuthZ.AllowUnauthenticated {
+			return uid, nil
+		}
+		return 0, fmt.Errorf("the request is not authenticated")
+	}
+	u, err := suser.LookupUser(authUser)
+	if err != nil {
+		return 0, fmt.Errorf("lookup user %s failed: %v", authUser, err)
+	}
+	if uid != u.UID {
+		return 0, fmt.Errorf("container must run as user %s", authUser)
+	}
+	return uid, nil
+}
+
+// resolveID parses the numeric id, e.g. 0 and 0000 are both root, or looks
+// up the id of the name.
+func resolveID(id string, lookup func(string) (int, error)) (int, error) {
+	if id == "" {
+		return 0, fmt.Errorf("empty id")
+	}
+	if n, err := strconv.ParseUint(id, 10, 32); err == nil {
+		return int(n), nil
+	}
+	return lookup(id)
+}
@@ -0,0 +1,170 @@
+// Copyright (c) 2018 China-HPC.
+
+package socker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/kr/pty"
+	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Client is an unprivileged socker client which runs commands via daemon.
+type Client struct {
+	socketPath string
+}
+
+// NewClient creates a socker client connects to the daemon at socketPath.
+func NewClient(socketPath string) *Client {
+	socketPath = strings.TrimPrefix(socketPath, "unix://")
+	if socketPath == "" {
+		socketPath = DefaultDaemonSocket
+	}
+	return &Client{socketPath: socketPath}
+}
+
+// Call sends the command to socker daemon with local standard streams
+// attached, the exit status of the command is returned as a cli.ExitError.
+func (c *Client) Call(command string, args []string) error {
+	tty, interactive := streamModes(command, args)
+	conn, err := net.Dial("unix", c.socketPath)
+	if err != nil {
+		return fmt.Errorf("connect to socker daemon failed: %v", err)
+	}
+	defer conn.Close()
+	data, err := json.Marshal(&Request{
+		Command: command,
+		Args:    args,
+		TTY:     tty,
+	})
+	if err != nil {
+		return err
+	}
+	var mu sync.Mutex
+	if err := writeFrame(conn, frameRequest, data); err != nil {
+		return err
+	}
+	if tty {
+		oldState, err := terminal.MakeRaw(int(os.Stdin.Fd()))
+		if err != nil {
+			return err
+		}
+		defer func() { _ = terminal.Restore(int(os.Stdin.Fd()), oldState) }()
+		go forwardResize(conn, &mu)
+	}
+	if tty || interactive {
+		go forwardStdin(conn, &mu)
+	}
+	// the container is stopped by daemon if the client is terminated, by the
+	// signals forwarded or by the connection closed when it is killed.
+	if command == "run" {
+		signals := make(chan os.Signal, len(signalNames))
+		for _, sig := range signalNames {
+			signal.Notify(signals, sig)
+		}
+		defer signal.Stop(signals)
+		go forwardClientSignals(conn, &mu, signals)
+	}
+	for {
+		typ, payload, err := readFrame(conn)
+		if err != nil {
+			return fmt.Errorf("read from socker daemon failed: %v", err)
+		}
+		switch typ {
+		case frameStdout:
+			os.Stdout.Write(payload)
+		case frameStderr:
+			os.Stderr.Write(payload)
+		case frameExit:
+			status := exitStatus{}
+			if err := json.Unmarshal(payload, &status); err != nil {
+				return fmt.Errorf("decode exit status failed: %v", err)
+			}
+			if status.Code == 0 {
+				return nil
+			}
+			return cli.NewExitError(status.Error, status.Code)
+		default:
+			log.Debugf("unexpected frame type: %d", typ)
+		}
+	}
+}
+
+func forwardClientSignals(conn io.Writer, mu *sync.Mutex, signals <-chan os.Signal) {
+	for sig := range signals {
+		num, ok := sig.(syscall.Signal)
+		if !ok {
+			continue
+		}
+		mu.Lock()
+		err := writeFrame(conn, frameSignal, []byte(strconv.Itoa(int(num))))
+		mu.Unlock()
+		if err != nil {
+			log.Debugf("forward signal failed: %v", err)
+			return
+		}
+	}
+}
+
+func forwardStdin(conn io.Writer, mu *sync.Mutex) {
+	stdin := &frameWriter{mu: mu, w: conn, typ: frameStdin}
+	if _, err := io.Copy(stdin, os.Stdin); err != nil {
+		log.Debugf("forward stdin failed: %v", err)
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	writeFrame(conn, frameStdinClose, nil)
+}
+
+func forwardResize(conn io.Writer, mu *sync.Mutex) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGWINCH)
+	ch <- syscall.SIGWINCH // Initial resize.
+	for range ch {
+		ws, err := pty.GetsizeFull(os.Stdin)
+		if err != nil {
+			log.Debugf("get terminal size failed: %v", err)
+			continue
+		}
+		data, err := json.Marshal(ws)
+		if err != nil {
+			continue
+		}
+		mu.Lock()
+		err = writeFrame(conn, frameResize, data)
+		mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// streamModes reports whether the command requests a TTY and whether it
+// keeps stdin open.
+func streamModes(command string, args []string) (bool, bool) {
+	switch command {
+	case "run":
+		opts := Opts{}
+		if _, err := parseArgs(&opts, args); err == nil {
+			return opts.TTY, opts.Interactive
+		}
+	case "exec":
+		opts := ExecOpts{}
+		if _, err := parseArgs(&opts, args); err == nil {
+			return opts.TTY, opts.Interactive
+		}
+	}
+	return false, false
+}
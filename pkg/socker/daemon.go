@@ -0,0 +1,246 @@
+// Copyright (c) 2018 China-HPC.
+
+package socker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/kr/pty"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// DefaultDaemonSocket is the default unix socket socker daemon listens on.
+	DefaultDaemonSocket = "/var/run/socker.sock"
+	permDaemonSocket    = 0666
+)
+
+// Daemon serves socker commands for unprivileged clients over a unix socket,
+// the clients are authenticated by the kernel provided peer credentials.
+type Daemon struct {
+	s          *Socker
+	socketPath string
+}
+
+// NewDaemon creates a socker daemon listens on the socketPath.
+func NewDaemon(s *Socker, socketPath string) *Daemon {
+	if socketPath == "" {
+		socketPath = DefaultDaemonSocket
+	}
+	s.serving = true
+	return &Daemon{
+		s:          s,
+		socketPath: socketPath,
+	}
+}
+
+// Serve accepts client connections and serves them until listener failed.
+func (d *Daemon) Serve() error {
+	if err := os.Remove(d.socketPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove stale socket failed: %v", err)
+	}
+	l, err := net.Listen("unix", d.socketPath)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	if err := os.Chmod(d.socketPath, permDaemonSocket); err != nil {
+		return err
+	}
+	log.Infof("socker daemon is listening on %s", d.socketPath)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Errorf("accept connection failed: %v", err)
+			return err
+		}
+		go d.handle(conn.(*net.UnixConn))
+	}
+}
+
+func (d *Daemon) handle(conn *net.UnixConn) {
+	defer conn.Close()
+	cred, err := peerCred(conn)
+	if err != nil {
+		log.Errorf("get peer credential failed: %v", err)
+		return
+	}
+	typ, payload, err := readFrame(conn)
+	if err != nil || typ != frameRequest {
+		log.Errorf("read request from uid %d failed: %v", cred.Uid, err)
+		return
+	}
+	var req Request
+	if err := json.Unmarshal(payload, &req); err != nil {
+		log.Errorf("decode request from uid %d failed: %v", cred.Uid, err)
+		return
+	}
+	log.Debugf("uid %d requests: %s %v", cred.Uid, req.Command, req.Args)
+
+	var mu sync.Mutex
+	stdinReader, stdinWriter := io.Pipe()
+	defer stdinReader.Close()
+	streams := &Streams{
+		Stdin:  stdinReader,
+		Stdout: &frameWriter{mu: &mu, w: conn, typ: frameStdout},
+		Stderr: &frameWriter{mu: &mu, w: conn, typ: frameStderr},
+	}
+	var resize chan *pty.Winsize
+	if req.TTY {
+		resize = make(chan *pty.Winsize, 1)
+		streams.Resize = resize
+	}
+	signals := make(chan os.Signal, len(signalNames))
+	streams.Signals = signals
+	hangup := make(chan struct{})
+	streams.Hangup = hangup
+	done := make(chan struct{})
+	defer close(done)
+	go demuxClient(conn, stdinWriter, resize, signals, hangup, done)
+
+	status := exitStatus{}
+	caller, err := d.s.ForCaller(cred.Uid, int(cred.Pid), peerEnviron(cred), streams)
+	if err == nil {
+		err = caller.dispatch(req.Command, req.Args)
+	}
+	if err != nil {
+		entry := log.WithField(fieldUID, cred.Uid)
+		if caller != nil {
+			entry = caller.logger()
+		}
+		entry.Errorf("serve %s failed: %v", req.Command, err)
+		status.Code = ExitCode(err)
+		status.Error = err.Error()
+	}
+	data, err := json.Marshal(status)
+	if err != nil {
+		log.Errorf("marshal exit status failed: %v", err)
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if err := writeFrame(conn, frameExit, data); err != nil {
+		log.Errorf("send exit status to uid %d failed: %v", cred.Uid, err)
+	}
+}
+
+// demuxClient dispatches the frames sent by client to the command streams,
+// hangup is closed when the connection is closed by client.
+func demuxClient(conn io.Reader, stdin *io.PipeWriter, resize chan *pty.Winsize,
+	signals chan os.Signal, hangup chan struct{}, done <-chan struct{}) {
+	defer stdin.Close()
+	if resize != nil {
+		defer close(resize)
+	}
+	for {
+		typ, payload, err := readFrame(conn)
+		if err != nil {
+			log.Debugf("read from client failed: %v", err)
+			close(hangup)
+			return
+		}
+		switch typ {
+		case frameStdin:
+			if _, err := stdin.Write(payload); err != nil {
+				log.Debugf("write stdin failed: %v", err)
+			}
+		case frameStdinClose:
+			stdin.Close()
+		case frameResize:
+			if resize == nil {
+				continue
+			}
+			ws := &pty.Winsize{}
+			if err := json.Unmarshal(payload, ws); err != nil {
+				log.Debugf("decode terminal size failed: %v", err)
+				continue
+			}
+			select {
+			case resize <- ws:
+			case <-done:
+				return
+			}
+		case frameSignal:
+			num, err := strconv.Atoi(string(payload))
+			if err != nil {
+				log.Debugf("decode signal failed: %v", err)
+				continue
+			}
+			// the signal is dropped if the command is not handling signals.
+			select {
+			case signals <- syscall.Signal(num):
+			default:
+			}
+		default:
+			log.Debugf("unexpected frame type: %d", typ)
+		}
+	}
+}
+
+// dispatch runs a socker command which can be served by daemon.
+func (s *Socker) dispatch(command string, args []string) error {
+	if err := s.Authorize(command); err != nil {
+		return err
+	}
+	switch command {
+	case "run":
+		return s.RunImage(args)
+	case "exec":
+		return s.Exec(args)
+	case "ps":
+		return s.Ps(args)
+	case "logs":
+		return s.Logs(args)
+	case "stop":
+		return s.Stop(args)
+	}
+	return fmt.Errorf("unsupported command: %s", command)
+}
+
+func peerCred(conn *net.UnixConn) (*unix.Ucred, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var cred *unix.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd),
+			unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cred, credErr
+}
+
+// peerEnviron reads the environment of the peer process, it is trusted only
+// if the process is still owned by the peer user.
+func peerEnviron(cred *unix.Ucred) []string {
+	procDir := fmt.Sprintf("/proc/%d", cred.Pid)
+	info, err := os.Stat(procDir)
+	if err != nil {
+		log.Debugf("stat peer process failed: %v", err)
+		return nil
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); !ok || stat.Uid != cred.Uid {
+		log.Debugf("peer process %d is not owned by uid %d", cred.Pid, cred.Uid)
+		return nil
+	}
+	data, err := ioutil.ReadFile(procDir + "/environ")
+	if err != nil {
+		log.Debugf("read peer environ failed: %v", err)
+		return nil
+	}
+	return strings.Split(strings.TrimRight(string(data), "\x00"), "\x00")
+}
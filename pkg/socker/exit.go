@@ -0,0 +1,82 @@
+// Copyright (c) 2018 China-HPC.
+
+package socker
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// The reserved exit codes of socker, the other codes are the exit codes of
+// container processes. Docker exits with 125 if the daemon fails, 126 if the
+// container command can't be invoked and 127 if it is not found.
+const (
+	// ExitCodeDenied is the exit code if socker refuses the command.
+	ExitCodeDenied = 122
+	// ExitCodeError is the exit code if socker or Docker daemon fails.
+	ExitCodeError = 125
+	// exitCodeSignal is added to the signal number if the process is killed.
+	exitCodeSignal = 128
+)
+
+// ExitError is an error with the exit code of socker, the message is empty
+// if the container process exits with non-zero code.
+type ExitError struct {
+	Code int
+	Err  error
+}
+
+func (e *ExitError) Error() string {
+	if e.Err == nil {
+		return ""
+	}
+	return e.Err.Error()
+}
+
+// ExitCode returns the exit code of err, it is 1 for the errors without an
+// exit code.
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if e, ok := err.(*ExitError); ok {
+		return e.Code
+	}
+	return 1
+}
+
+// denied returns the error of a refused command.
+func denied(err error) error {
+	if _, ok := err.(*ExitError); ok {
+		return err
+	}
+	return &ExitError{Code: ExitCodeDenied, Err: err}
+}
+
+// failed returns the error of socker failing to prepare a command, e.g. a
+// file operation or a docker command fails, it is not a refusal.
+func failed(err error) error {
+	if _, ok := err.(*ExitError); ok {
+		return err
+	}
+	return &ExitError{Code: ExitCodeError, Err: err}
+}
+
+// commandError returns the error of a docker command with the exit code of
+// its process, it is 128+N if the process is killed by signal N.
+func commandError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*ExitError); ok {
+		return err
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return &ExitError{Code: ExitCodeError, Err: err}
+	}
+	if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return &ExitError{Code: exitCodeSignal + int(ws.Signal())}
+	}
+	return &ExitError{Code: exitErr.ExitCode()}
+}
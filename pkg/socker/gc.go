@@ -0,0 +1,334 @@
+// Copyright (c) 2018 China-HPC.
+
+package socker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/China-HPC/go-socker/pkg/su"
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// DefaultGCTTL is the time stopped containers are kept for.
+	DefaultGCTTL = 24 * time.Hour
+	// gcGracePeriod protects the state of the containers being started, e.g.
+	// pulling their images, from being collected.
+	gcGracePeriod = time.Hour
+)
+
+// cgroupRoot is where the cgroup hierarchies are mounted.
+var cgroupRoot = "/sys/fs/cgroup"
+
+// procRoot is where the proc filesystem is mounted.
+var procRoot = "/proc"
+
+// GCOpts represents the options of collecting orphaned containers and state.
+type GCOpts struct {
+	// DryRun prints what would be removed without removing anything.
+	DryRun bool
+	// TTL is the time stopped containers are kept for.
+	TTL time.Duration
+}
+
+// containerState is the state of a socker container reported by docker
+// inspect.
+type containerState struct {
+	Name    string    `json:"Name"`
+	Created time.Time `json:"Created"`
+	State   struct {
+		Running    bool      `json:"Running"`
+		FinishedAt time.Time `json:"FinishedAt"`
+	} `json:"State"`
+	Config struct {
+		Labels map[string]string `json:"Labels"`
+	} `json:"Config"`
+}
+
+// collector collects the orphaned containers and state of a GC run.
+type collector struct {
+	s    *Socker
+	opts GCOpts
+	now  time.Time
+	// containers are the names of the containers exist after the run.
+	containers map[string]bool
+	// removed are the names of the containers removed by the run.
+	removed map[string]bool
+	failed  int
+}
+
+// GC removes the containers whose Slurm job has ended or whose socker process
+// died, the stopped containers older than the TTL, and the state left by the
+// removed containers: the owner and job records, the run directories and the
+// job scratch directories.
+func (s *Socker) GC(opts GCOpts) error {
+	c := &collector{s: s, opts: opts, now: time.Now(),
+		containers: map[string]bool{}, removed: map[string]bool{}}
+	containers, err := s.listContainers()
+	if err != nil {
+		return fmt.Errorf("list containers failed: %v", err)
+	}
+	jobs := jobRecords()
+	for _, container := range containers {
+		c.collectContainer(container, jobs)
+	}
+	c.collectRecords()
+	c.collectRunDirs()
+	c.collectScratchDirs()
+	if c.failed > 0 {
+		return fmt.Errorf("%d of the removals failed", c.failed)
+	}
+	return nil
+}
+
+// act prints the action and runs it unless in dry run.
+func (c *collector) act(action func() error, format string, args ...interface{}) bool {
+	msg := fmt.Sprintf(format, args...)
+	if c.opts.DryRun {
+		fmt.Fprintf(c.s.streams.Stdout, "would %s\n", msg)
+		return true
+	}
+	fmt.Fprintln(c.s.streams.Stdout, msg)
+	if err := action(); err != nil {
+		log.Errorf("%s failed: %v", msg, err)
+		c.failed++
+		return false
+	}
+	return true
+}
+
+func (c *collector) collectContainer(container *containerState, jobs map[string]string) {
+	name := strings.TrimPrefix(container.Name, "/")
+	c.containers[name] = true
+	remove := func() error { return c.removeContainer(name) }
+	reason := ""
+	if container.State.Running {
+		job := container.Config.Labels[labelJob]
+		if job == "" {
+			job = jobs[name]
+		}
+		l, err := readLease(name)
+		if job == "" && err == nil {
+			job = l.JobID
+		}
+		if exists, known := jobCgroupExists(job); job != "" && known && !exists {
+			reason = fmt.Sprintf("job %s has ended", job)
+			remove = func() error {
+				c.s.stopContainer(name)
+				return c.removeContainer(name)
+			}
+		} else if err == nil && l.expired() && !isProcessExisted(strconv.Itoa(l.Supervisor)) {
+			// the stopped container is removed after the TTL.
+			c.act(func() error { return c.stopContainer(name) },
+				"stop container %s: its socker process %d has exited", name, l.PID)
+			return
+		}
+	} else {
+		finished := container.State.FinishedAt
+		if finished.IsZero() {
+			finished = container.Created
+		}
+		if age := c.now.Sub(finished); age > c.opts.TTL {
+			reason = fmt.Sprintf("it has been stopped for %v", age.Round(time.Second))
+		}
+	}
+	if reason == "" {
+		return
+	}
+	if c.act(remove, "remove container %s: %s", name, reason) {
+		delete(c.containers, name)
+		c.removed[name] = true
+	}
+}
+
+func (c *collector) stopContainer(name string) error {
+	timeout := c.s.policy.Signals.StopTimeout
+	output, err := su.CombinedOutput(c.s.dockerUID, cmdDocker, "stop",
+		"--time", strconv.Itoa(timeout), name)
+	if err != nil {
+		return fmt.Errorf("%v:%s", err, output)
+	}
+	return nil
+}
+
+func (c *collector) removeContainer(name string) error {
+	output, err := su.CombinedOutput(c.s.dockerUID, cmdDocker, "rm", "--force",
+		"--volumes", name)
+	if err != nil {
+		return fmt.Errorf("%v:%s", err, output)
+	}
+	return nil
+}
+
+// isStale reports whether the state of container can be removed, the state
+// younger than the grace period may belong to a container being started.
+func (c *collector) isStale(container string, modTime time.Time) bool {
+	if c.containers[container] {
+		return false
+	}
+	return c.removed[container] || c.now.Sub(modTime) > gcGracePeriod
+}
+
+// collectRecords removes the owner and job records whose container is gone,
+// a job record is named by the job id and contains the container name.
+func (c *collector) collectRecords() {
+	infos, err := ioutil.ReadDir(epilogDir)
+	if err != nil {
+		log.Errorf("read %s failed: %v", epilogDir, err)
+		c.failed++
+		return
+	}
+	for _, info := range infos {
+		name := info.Name()
+		container := strings.TrimSuffix(name, "-pids")
+		if c.containers[container] {
+			continue
+		}
+		if jobIDPattern.MatchString(name) {
+			data, err := ioutil.ReadFile(path.Join(epilogDir, name))
+			if err == nil && !jobIDPattern.MatchString(strings.TrimSpace(string(data))) {
+				container = strings.TrimSpace(string(data))
+			}
+		}
+		if !c.isStale(container, info.ModTime()) {
+			continue
+		}
+		file := path.Join(epilogDir, name)
+		c.act(func() error { return os.Remove(file) },
+			"remove record %s: container %s is gone", file, container)
+	}
+}
+
+// collectRunDirs removes the run directories whose container is gone.
+func (c *collector) collectRunDirs() {
+	infos, err := ioutil.ReadDir(runDir)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Errorf("read %s failed: %v", runDir, err)
+		c.failed++
+		return
+	}
+	for _, info := range infos {
+		container := info.Name()
+		if !info.IsDir() || !c.isStale(container, info.ModTime()) {
+			continue
+		}
+		// the container is being started by a living socker process.
+		if l, err := readLease(container); err == nil && !l.expired() {
+			continue
+		}
+		dir := path.Join(runDir, container)
+		c.act(func() error { return os.RemoveAll(dir) },
+			"remove run directory %s: container %s is gone", dir, container)
+	}
+}
+
+// collectScratchDirs removes the job scratch directories whose job has ended,
+// they are left if the epilog is not configured. The swap directories in
+// home directories hold the data of users and are never removed.
+func (c *collector) collectScratchDirs() {
+	base := c.s.policy.JobScratch.Base
+	if base == "" {
+		return
+	}
+	infos, err := ioutil.ReadDir(base)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Errorf("read %s failed: %v", base, err)
+		c.failed++
+		return
+	}
+	for _, info := range infos {
+		job := info.Name()
+		if !info.IsDir() || !jobIDPattern.MatchString(job) ||
+			c.now.Sub(info.ModTime()) <= gcGracePeriod {
+			continue
+		}
+		if exists, known := jobCgroupExists(job); !known || exists {
+			continue
+		}
+		dir := path.Join(base, job)
+		c.act(func() error { return os.RemoveAll(dir) },
+			"remove scratch directory %s: job %s has ended", dir, job)
+	}
+}
+
+// listContainers lists all the containers started by socker.
+func (s *Socker) listContainers() ([]*containerState, error) {
+	output, err := su.Output(s.dockerUID, cmdDocker, "ps", "--all", "--quiet",
+		"--no-trunc", "--filter", fmt.Sprintf("label=%s", labelOwner))
+	if err != nil {
+		return nil, err
+	}
+	ids := strings.Fields(string(output))
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	output, err = su.Output(s.dockerUID, cmdDocker, append([]string{"inspect"}, ids...)...)
+	if err != nil {
+		return nil, err
+	}
+	containers := []*containerState{}
+	if err := json.Unmarshal(output, &containers); err != nil {
+		return nil, err
+	}
+	return containers, nil
+}
+
+// jobRecords returns the job ids of containers recorded for the epilog.
+func jobRecords() map[string]string {
+	jobs := map[string]string{}
+	infos, err := ioutil.ReadDir(epilogDir)
+	if err != nil {
+		return jobs
+	}
+	for _, info := range infos {
+		if !jobIDPattern.MatchString(info.Name()) {
+			continue
+		}
+		data, err := ioutil.ReadFile(path.Join(epilogDir, info.Name()))
+		if err != nil {
+			continue
+		}
+		jobs[strings.TrimSpace(string(data))] = info.Name()
+	}
+	return jobs
+}
+
+// jobCgroupExists reports whether the cgroup of Slurm job exists, known is
+// false if Slurm cgroups are not found on the node.
+func jobCgroupExists(job string) (exists bool, known bool) {
+	if !jobIDPattern.MatchString(job) {
+		return false, false
+	}
+	// cgroup v1 with the hierarchy slurm/uid_<uid>/job_<id>, and cgroup v2
+	// with the slurmstepd scope.
+	roots := []string{
+		path.Join(cgroupRoot, "memory", "slurm*"),
+		path.Join(cgroupRoot, "system.slice", "slurmstepd.scope"),
+	}
+	for _, root := range roots {
+		matches, _ := filepath.Glob(root)
+		for _, match := range matches {
+			known = true
+			jobs, _ := filepath.Glob(path.Join(match, "uid_*", "job_"+job))
+			direct, _ := filepath.Glob(path.Join(match, "job_"+job))
+			if len(jobs)+len(direct) > 0 {
+				return true, true
+			}
+		}
+	}
+	return false, known
+}
@@ -0,0 +1,313 @@
+// Copyright (c) 2018 China-HPC.
+
+package socker
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/China-HPC/go-socker/pkg/su"
+	suser "github.com/China-HPC/go-socker/pkg/user"
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// supervisorName is the argv[0] socker is re-executed with as the
+	// supervisor of a container.
+	supervisorName = "socker-supervisor"
+	leaseFile      = "lease"
+	// the lease carries the token of supervisor, it is readable only by root.
+	permLeaseFile = 0600
+	permLeaseDir  = 0700
+	// leaseReleased is written to the supervisor when socker exits normally.
+	leaseReleased = 'r'
+	// the size of the random token of lease, it is hex encoded.
+	leaseTokenSize = 32
+)
+
+// lease ties the lifetime of a container to the socker process started it,
+// the container is stopped by the supervisor if the process dies, and by
+// socker gc if both of them are gone.
+type lease struct {
+	Container string `json:"container"`
+	// ID is the id of the container created by the socker process.
+	ID    string `json:"id"`
+	UID   string `json:"uid"`
+	JobID string `json:"job_id,omitempty"`
+	// PID is the socker process holds the lease, or the client of socker
+	// daemon.
+	PID int `json:"pid"`
+	// Parent is the socker process started the supervisor, it is the daemon
+	// if PID is its client.
+	Parent int `json:"parent"`
+	// Supervisor is the process stops the container when PID dies.
+	Supervisor int       `json:"supervisor"`
+	Created    time.Time `json:"created"`
+	// Token is written to the pipe of the supervisor by the socker process
+	// started it, the lease is readable only by root so the supervisor can't
+	// be started by others.
+	Token string `json:"token"`
+}
+
+// selfExe is the socker executable re-executed as the supervisor.
+var selfExe = "/proc/self/exe"
+
+func leasePath(container string) string {
+	return path.Join(runDir, container, leaseFile)
+}
+
+// readLease reads the lease of container.
+func readLease(container string) (*lease, error) {
+	data, err := ioutil.ReadFile(leasePath(container))
+	if err != nil {
+		return nil, err
+	}
+	l := &lease{}
+	if err := json.Unmarshal(data, l); err != nil {
+		return nil, fmt.Errorf("parse lease of container %s failed: %v", container, err)
+	}
+	return l, nil
+}
+
+// expired reports whether the socker process holds the lease has exited.
+func (l *lease) expired() bool {
+	return !isProcessExisted(strconv.Itoa(l.PID))
+}
+
+// acquireLease starts the supervisor of the container created with the id and
+// writes its lease, the returned function releases the lease when socker
+// exits normally.
+func (s *Socker) acquireLease(id string) (func(), error) {
+	token := make([]byte, leaseTokenSize)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	cmd := exec.Command(selfExe, s.containerUUID,
+		strconv.Itoa(s.policy.Signals.StopTimeout))
+	cmd.Args[0] = supervisorName
+	cmd.ExtraFiles = []*os.File{r}
+	cmd.Stderr = os.Stderr
+	// the supervisor is notified by the end of pipe when socker dies, the
+	// parent death signal is a fallback since it is cleared by the exec of
+	// setuid socker. It is in its own process group to keep off the signals
+	// of terminal.
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Pdeathsig: syscall.SIGTERM,
+		Setpgid:   true,
+	}
+	l := &lease{
+		Container: s.containerUUID,
+		ID:        id,
+		UID:       s.CurrentUID,
+		JobID:     s.slurmJobID,
+		PID:       os.Getpid(),
+		Parent:    os.Getpid(),
+		Created:   time.Now(),
+		Token:     hex.EncodeToString(token),
+	}
+	if s.clientPID > 0 {
+		l.PID = s.clientPID
+	}
+	if err := writeLease(l); err != nil {
+		w.Close()
+		return nil, err
+	}
+	// the token is buffered in the pipe until the supervisor reads it.
+	if _, err := w.Write([]byte(l.Token)); err != nil {
+		w.Close()
+		os.Remove(leasePath(s.containerUUID))
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		w.Close()
+		os.Remove(leasePath(s.containerUUID))
+		return nil, fmt.Errorf("start supervisor failed: %v", err)
+	}
+	l.Supervisor = cmd.Process.Pid
+	// the processes in the cgroups of job step are killed when the step
+	// ends, the supervisor must outlive socker to stop the container.
+	if err := leaveJobCgroups(l.Supervisor); err != nil {
+		s.logger().Warnf("move supervisor of container %s out of job cgroups failed: %v",
+			s.containerUUID, err)
+	}
+	if err := writeLease(l); err != nil {
+		s.logger().Warnf("update lease of container %s failed: %v", s.containerUUID, err)
+	}
+	return func() {
+		w.Write([]byte{leaseReleased})
+		w.Close()
+		cmd.Wait()
+		os.Remove(leasePath(l.Container))
+	}, nil
+}
+
+// leaveJobCgroups moves the process from the cgroups of Slurm job to the
+// root cgroups of their hierarchies.
+func leaveJobCgroups(pid int) error {
+	data, err := ioutil.ReadFile(path.Join(procRoot, strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return err
+	}
+	for _, dir := range jobCgroupRoots(string(data)) {
+		err := ioutil.WriteFile(path.Join(dir, "cgroup.procs"),
+			[]byte(strconv.Itoa(pid)), permLeaseFile)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// jobCgroupRoots returns the root directories of the hierarchies in which
+// the process is in a cgroup of Slurm job, data is the content of
+// /proc/<pid>/cgroup, e.g. "4:memory:/slurm/uid_1000/job_42/step_0".
+func jobCgroupRoots(data string) []string {
+	var roots []string
+	for _, line := range strings.Split(strings.TrimSpace(data), lineBrk) {
+		fields := strings.SplitN(line, sepColon, 3)
+		if len(fields) != 3 || !jobCgroupPattern.MatchString(fields[2]) {
+			continue
+		}
+		// the unified hierarchy of cgroup v2 has no controllers.
+		root := cgroupRoot
+		if fields[1] != "" {
+			root = path.Join(cgroupRoot, strings.TrimPrefix(fields[1], "name="))
+		}
+		roots = append(roots, root)
+	}
+	return roots
+}
+
+// writeLease writes the lease to the run directory of the container, which is
+// created if the container has no passwd files in it.
+func writeLease(l *lease) error {
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(leasePath(l.Container)), permLeaseDir); err != nil {
+		return err
+	}
+	tmp := leasePath(l.Container) + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, permLeaseFile); err != nil {
+		return err
+	}
+	return os.Rename(tmp, leasePath(l.Container))
+}
+
+// verify reads the token from the pipe of the supervisor and compares it with
+// the token of lease.
+func (l *lease) verify(pipe io.Reader) error {
+	token := make([]byte, hex.EncodedLen(leaseTokenSize))
+	if _, err := io.ReadFull(pipe, token); err != nil {
+		return fmt.Errorf("read lease token failed: %v", err)
+	}
+	if l.Token == "" || subtle.ConstantTimeCompare(token, []byte(l.Token)) != 1 {
+		return fmt.Errorf("lease token of container %s mismatched", l.Container)
+	}
+	return nil
+}
+
+// IsSupervisor reports whether socker is executed as the supervisor of a
+// container.
+func IsSupervisor() bool {
+	return len(os.Args) > 0 && os.Args[0] == supervisorName
+}
+
+// Supervise waits on the socker process started it and stops the container
+// unless the lease is released, it returns the exit code of the supervisor.
+func Supervise(args []string) int {
+	if len(args) != 2 {
+		fmt.Fprintf(os.Stderr, "usage: %s CONTAINER STOP_TIMEOUT\n", supervisorName)
+		return 2
+	}
+	container := args[0]
+	timeout, err := strconv.Atoi(args[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid stop timeout: %v\n", err)
+		return 2
+	}
+	if !volumeNamePattern.MatchString(container) {
+		fmt.Fprintf(os.Stderr, "invalid container name %s\n", container)
+		return 2
+	}
+	// only the socker process holds the lease can start the supervisor, so
+	// users can't stop the containers of others by it. The supervisor is
+	// selected by argv[0] which anyone can set, the token of lease is checked
+	// before anything else runs.
+	l, err := readLease(container)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "read lease failed: %v\n", err)
+		return 1
+	}
+	pipe := os.NewFile(3, "lease")
+	if err := l.verify(pipe); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	signal.Ignore(syscall.SIGINT, syscall.SIGHUP, syscall.SIGQUIT)
+	terminated := make(chan os.Signal, 1)
+	signal.Notify(terminated, syscall.SIGTERM)
+	released := make(chan bool, 1)
+	go func() {
+		buf := make([]byte, 1)
+		n, _ := pipe.Read(buf)
+		released <- n == 1 && buf[0] == leaseReleased
+	}()
+	// the client of daemon is not the parent, it is polled.
+	ticker := time.NewTicker(enforceInterval)
+	defer ticker.Stop()
+wait:
+	for {
+		select {
+		case ok := <-released:
+			if ok {
+				return 0
+			}
+			break wait
+		case <-terminated:
+			// the signal is sent by others while socker is alive.
+			if os.Getppid() != l.Parent {
+				break wait
+			}
+		case <-ticker.C:
+			if l.expired() {
+				break wait
+			}
+		}
+	}
+	log.Warnf("socker process %d exited, stop container %s", l.PID, container)
+	u, err := suser.LookupUser(dockerUser)
+	if err != nil {
+		log.Errorf("lookup user %s failed: %v", dockerUser, err)
+		return 1
+	}
+	// the container is stopped by the id, it can't be another container of
+	// the same name.
+	output, err := su.CombinedOutput(strconv.Itoa(u.UID), cmdDocker, "stop",
+		"--time", strconv.Itoa(timeout), l.ID)
+	if err != nil {
+		log.Errorf("stop container %s failed: %v:%s", container, err, output)
+		return 1
+	}
+	os.RemoveAll(path.Join(runDir, container))
+	return 0
+}
@@ -0,0 +1,197 @@
+// Copyright (c) 2018 China-HPC.
+
+package socker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log/syslog"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	logTag            = "socker"
+	journaldSocket    = "/run/systemd/journal/socket"
+	prefixJournalKey  = "SOCKER_"
+	fieldUser         = "user"
+	fieldUID          = "uid"
+	fieldJob          = "job"
+	fieldContainer    = "container"
+	syslogFacility    = syslog.LOG_DAEMON
+	maxJournalMessage = 1 << 16
+)
+
+var journalKeyInvalidChars = regexp.MustCompile(`[^A-Z0-9_]`)
+
+// LogPolicy defines the sinks socker's own logs are sent to besides stderr.
+type LogPolicy struct {
+	// Syslog sends logs to the local syslog by /dev/log.
+	Syslog bool `yaml:"syslog"`
+	// Journald sends logs to the native socket of systemd-journald.
+	Journald bool `yaml:"journald"`
+}
+
+// setupLogSinks adds the context fields to logs and sends them to the sinks
+// defined by site policy, a sink is skipped if it is unavailable.
+func (s *Socker) setupLogSinks() {
+	log.AddHook(&contextHook{s: s})
+	if s.policy.Log.Syslog {
+		w, err := syslog.New(syslogFacility|syslog.LOG_INFO, logTag)
+		if err != nil {
+			log.Warnf("connect to syslog failed: %v", err)
+		} else {
+			log.AddHook(&syslogHook{w: w})
+		}
+	}
+	if s.policy.Log.Journald {
+		conn, err := net.Dial("unixgram", journaldSocket)
+		if err != nil {
+			log.Warnf("connect to journald failed: %v", err)
+		} else {
+			log.AddHook(&journaldHook{conn: conn})
+		}
+	}
+}
+
+// contextHook adds the user, job and container that socker acts on behalf
+// of to the log entries if they are not specified. The daemon acts on behalf
+// of many callers at once, they are logged by their own entries instead.
+type contextHook struct {
+	s *Socker
+}
+
+func (h *contextHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *contextHook) Fire(entry *log.Entry) error {
+	if h.s.serving {
+		return nil
+	}
+	for key, value := range h.s.logFields() {
+		if _, ok := entry.Data[key]; !ok {
+			entry.Data[key] = value
+		}
+	}
+	return nil
+}
+
+// logger returns the log entry with the fields of the user, job and container
+// that socker acts on behalf of.
+func (s *Socker) logger() *log.Entry {
+	return log.WithFields(s.logFields())
+}
+
+// logFields returns the user, job and container fields of logs.
+func (s *Socker) logFields() log.Fields {
+	fields := log.Fields{}
+	for key, value := range map[string]string{
+		fieldUser:      s.currentUser,
+		fieldUID:       s.CurrentUID,
+		fieldJob:       s.slurmJobID,
+		fieldContainer: s.containerUUID,
+	} {
+		if value != "" {
+			fields[key] = value
+		}
+	}
+	return fields
+}
+
+// syslogHook sends the log entries to syslog, the fields are formatted as
+// key=value pairs after the message.
+type syslogHook struct {
+	w *syslog.Writer
+}
+
+var syslogFormatter = &log.TextFormatter{DisableTimestamp: true, DisableColors: true}
+
+func (h *syslogHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *syslogHook) Fire(entry *log.Entry) error {
+	data, err := syslogFormatter.Format(entry)
+	if err != nil {
+		return err
+	}
+	line := strings.TrimSpace(string(data))
+	switch entry.Level {
+	case log.PanicLevel, log.FatalLevel:
+		return h.w.Crit(line)
+	case log.ErrorLevel:
+		return h.w.Err(line)
+	case log.WarnLevel:
+		return h.w.Warning(line)
+	case log.InfoLevel:
+		return h.w.Info(line)
+	default:
+		return h.w.Debug(line)
+	}
+}
+
+// journaldHook sends the log entries to journald by its native protocol, the
+// fields are sent as journal fields prefixed with SOCKER_.
+type journaldHook struct {
+	conn net.Conn
+}
+
+func (h *journaldHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *journaldHook) Fire(entry *log.Entry) error {
+	buf := &bytes.Buffer{}
+	writeJournalField(buf, "MESSAGE", entry.Message)
+	writeJournalField(buf, "PRIORITY", fmt.Sprintf("%d", journalPriority(entry.Level)))
+	writeJournalField(buf, "SYSLOG_IDENTIFIER", logTag)
+	writeJournalField(buf, "SYSLOG_PID", fmt.Sprintf("%d", os.Getpid()))
+	for key, value := range entry.Data {
+		writeJournalField(buf, journalKey(key), fmt.Sprint(value))
+	}
+	if buf.Len() > maxJournalMessage {
+		return fmt.Errorf("journal entry size %d exceeds %d", buf.Len(), maxJournalMessage)
+	}
+	_, err := h.conn.Write(buf.Bytes())
+	return err
+}
+
+// writeJournalField writes a field in the journal export format, the values
+// contain newlines are written with their sizes.
+func writeJournalField(buf *bytes.Buffer, key, value string) {
+	if !strings.ContainsRune(value, '\n') {
+		fmt.Fprintf(buf, "%s=%s\n", key, value)
+		return
+	}
+	buf.WriteString(key)
+	buf.WriteByte('\n')
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+// journalKey converts the field key to a valid journal field name.
+func journalKey(key string) string {
+	return prefixJournalKey + journalKeyInvalidChars.ReplaceAllString(strings.ToUpper(key), "_")
+}
+
+func journalPriority(level log.Level) syslog.Priority {
+	switch level {
+	case log.PanicLevel, log.FatalLevel:
+		return syslog.LOG_CRIT
+	case log.ErrorLevel:
+		return syslog.LOG_ERR
+	case log.WarnLevel:
+		return syslog.LOG_WARNING
+	case log.InfoLevel:
+		return syslog.LOG_INFO
+	default:
+		return syslog.LOG_DEBUG
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright (c) 2018 China-HPC.
+
+package socker
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/China-HPC/go-socker/pkg/su"
+)
+
+const (
+	// confinementStrict stops and removes the container if it can't be
+	// confined in the job cgroups.
+	confinementStrict = "strict"
+	// confinementBestEffort keeps the container running with a warning.
+	confinementBestEffort = "best-effort"
+	eventStart            = "start"
+	eventDie              = "die"
+	// the interval of moving the new processes of container to job cgroup.
+	enforceInterval = time.Second
+)
+
+// containerEvent is an event of container reported by docker events.
+type containerEvent struct {
+	ID     string `json:"id"`
+	Action string `json:"Action"`
+}
+
+// monitor watches a container of the invocation and confines it in the
+// cgroups of the job once it starts.
+type monitor struct {
+	// confined is closed when the container has been confined.
+	confined chan struct{}
+	once     sync.Once
+	// err receives the error if the container can't be confined.
+	err chan error
+}
+
+func (m *monitor) markConfined() {
+	m.once.Do(func() { close(m.confined) })
+}
+
+// subscribeEvents subscribes the events of container, the events since the
+// subscription are replayed by Docker so the start is never missed. The
+// subscription is cancelled when ctx is done.
+func (s *Socker) subscribeEvents(ctx context.Context, container string) (<-chan containerEvent, <-chan error, error) {
+	since := strconv.FormatInt(time.Now().Unix(), 10)
+	cmd, err := su.CommandContext(ctx, s.dockerUID, cmdDocker, "events",
+		"--since", since,
+		"--filter", "type=container",
+		"--filter", fmt.Sprintf("container=%s", container),
+		"--format", "{{json .}}")
+	if err != nil {
+		return nil, nil, err
+	}
+	reader, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, nil, err
+	}
+	events := make(chan containerEvent)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(reader)
+		for scanner.Scan() {
+			event := containerEvent{}
+			if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+				s.logger().Debugf("decode container event failed: %v", err)
+				continue
+			}
+			select {
+			case events <- event:
+			case <-ctx.Done():
+			}
+		}
+		err := cmd.Wait()
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		} else if err == nil {
+			err = fmt.Errorf("docker events exited")
+		}
+		errs <- err
+	}()
+	return events, errs, nil
+}
+
+// startMonitor subscribes the events of the created container before it is
+// started, and confines it in the job cgroups when it starts. The container
+// must start in containerRunTimeout. The monitor stops when ctx is done.
+func (s *Socker) startMonitor(ctx context.Context, container string) (*monitor, error) {
+	events, errs, err := s.subscribeEvents(ctx, container)
+	if err != nil {
+		return nil, fmt.Errorf("subscribe container events failed: %v", err)
+	}
+	m := &monitor{confined: make(chan struct{}), err: make(chan error, 1)}
+	go func() {
+		timer := time.NewTimer(containerRunTimeout)
+		defer timer.Stop()
+		for {
+			select {
+			case event, ok := <-events:
+				if !ok {
+					m.err <- <-errs
+					return
+				}
+				if event.Action != eventStart {
+					continue
+				}
+				s.logger().Debugf("container %s started", container)
+				err := s.enforceLimit(ctx, m.markConfined)
+				if err == nil {
+					return
+				}
+				// nothing to confine if the container has exited.
+				if running, inspectErr := s.isContainerRunning(container); inspectErr == nil && !running {
+					s.logger().Debugf("container %s exited: %v", container, err)
+					m.markConfined()
+					return
+				}
+				m.err <- err
+				return
+			case <-timer.C:
+				m.err <- fmt.Errorf("container %s did not start in %v", container,
+					containerRunTimeout)
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return m, nil
+}
+
+// isContainerRunning reports whether the container is running.
+func (s *Socker) isContainerRunning(container string) (bool, error) {
+	output, err := su.Output(s.dockerUID, cmdDocker, "inspect", "--format",
+		"{{.State.Running}}", container)
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(output)) == "true", nil
+}
+
+// isBestEffort reports whether a container is kept running if it can't be
+// confined, either by site policy or by --best-effort of socker started by
+// root.
+func (s *Socker) isBestEffort() bool {
+	if s.policy != nil && s.policy.Confinement == confinementBestEffort {
+		return true
+	}
+	return s.Config != nil && s.BestEffort && s.rootStarted
+}
+
+// runMonitored runs the docker command by run, and aborts it by stopping and
+// removing the container if the container can't be confined, unless in the
+// best-effort mode. The ctx of run is cancelled to kill the docker command
+// before the container is removed, so a container that has not been started
+// yet when the confinement fails never runs unconfined. It is cancelled with
+// parent too.
+func (s *Socker) runMonitored(parent context.Context, m *monitor, container string, detach bool, run func(ctx context.Context) error) error {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	ran := make(chan error, 1)
+	go func() { ran <- run(ctx) }()
+	if m == nil {
+		return <-ran
+	}
+	var err error
+	select {
+	case runErr := <-ran:
+		if runErr != nil || !detach {
+			return runErr
+		}
+		// the detached container must be confined before socker exits.
+		select {
+		case <-m.confined:
+			return nil
+		case err = <-m.err:
+		}
+		if s.isBestEffort() {
+			s.logger().Warnf("container %s is not confined in job cgroups: %v", container, err)
+			return nil
+		}
+		s.removeContainer(container)
+	case err = <-m.err:
+		if s.isBestEffort() {
+			s.logger().Warnf("container %s is not confined in job cgroups: %v", container, err)
+			return <-ran
+		}
+		cancel()
+		<-ran
+		s.removeContainer(container)
+	}
+	s.logger().Errorf("confine container %s failed: %v", container, err)
+	return &ExitError{Code: ExitCodeError,
+		Err: fmt.Errorf("confine container in job cgroups failed: %v", err)}
+}
@@ -0,0 +1,250 @@
+// Copyright (c) 2018 China-HPC.
+
+package socker
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/China-HPC/go-socker/pkg/su"
+	suser "github.com/China-HPC/go-socker/pkg/user"
+)
+
+// runDir keeps the passwd files and the leases of containers.
+var runDir = "/var/lib/socker/run"
+
+const (
+	permRunDir     = 0755
+	permPasswdFile = 0644
+	filePasswd     = "/etc/passwd"
+	fileGroup      = "/etc/group"
+	// the shell of host may not exist in the image.
+	dftContainerShell = "/bin/sh"
+	maxAccountFile    = 1 << 20
+	rootPasswdEntry   = "root:x:0:0:root:/root:/bin/sh"
+	rootGroupEntry    = "root:x:0:"
+)
+
+// checkUser refuses to run the container as other users by --user, it can
+// only be current user and its primary group, and is normalized to uid:gid.
+// The container runs as its root, which is remapped, if it is not specified.
+func (s *Socker) checkUser(opts *Opts) error {
+	if opts.User == "" {
+		return nil
+	}
+	fields := strings.SplitN(opts.User, sepColon, 2)
+	if fields[0] != s.CurrentUID && fields[0] != s.currentUser {
+		return fmt.Errorf("--user %s is not permitted, containers can only run as %s",
+			opts.User, s.currentUser)
+	}
+	if len(fields) == 2 && fields[1] != s.currentGID && fields[1] != s.currentGroup {
+		return fmt.Errorf("--user %s is not permitted, the group must be %s",
+			opts.User, s.currentGroup)
+	}
+	opts.User = s.CurrentUID + sepColon + s.currentGID
+	return nil
+}
+
+// preparePasswd synthesizes the passwd and group files of the container from
+// the files of image and current user's entries, and returns the directory
+// they are written to. The directory is removed by the caller.
+func (s *Socker) preparePasswd(image string) (string, error) {
+	u, groups, err := s.callerAccounts()
+	if err != nil {
+		return "", err
+	}
+	files, err := s.readImageFiles(image, filePasswd, fileGroup)
+	if err != nil {
+		// the image is pulled by docker run if it's not existed, the files
+		// of minimal images are generated as well.
+		s.logger().Warnf("read account files of image %s failed: %v", image, err)
+		files = map[string][]byte{}
+	}
+	if err := os.MkdirAll(runDir, permRunDir); err != nil {
+		return "", err
+	}
+	dir := path.Join(runDir, s.containerUUID)
+	if err := os.Mkdir(dir, permRunDir); err != nil {
+		return "", err
+	}
+	passwd := mergePasswd(files[filePasswd], u)
+	err = ioutil.WriteFile(path.Join(dir, path.Base(filePasswd)), passwd, permPasswdFile)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	group := mergeGroup(files[fileGroup], groups)
+	err = ioutil.WriteFile(path.Join(dir, path.Base(fileGroup)), group, permPasswdFile)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// passwdArgs returns the docker run args mounting the account files in dir
+// and setting the environment of current user, the container must run as
+// current user.
+func (s *Socker) passwdArgs(dir string) []string {
+	return []string{
+		"-v", fmt.Sprintf("%s:%s:ro", path.Join(dir, path.Base(filePasswd)), filePasswd),
+		"-v", fmt.Sprintf("%s:%s:ro", path.Join(dir, path.Base(fileGroup)), fileGroup),
+		"-e", "HOME=" + s.homeDir,
+		"-e", "USER=" + s.currentUser,
+	}
+}
+
+// callerAccounts returns the user and groups entries of current user.
+func (s *Socker) callerAccounts() (*suser.User, []*suser.Group, error) {
+	uid, err := strconv.Atoi(s.CurrentUID)
+	if err != nil {
+		return nil, nil, err
+	}
+	gid, err := strconv.Atoi(s.currentGID)
+	if err != nil {
+		return nil, nil, err
+	}
+	u := &suser.User{
+		UID:   uid,
+		GID:   gid,
+		Name:  s.currentUser,
+		Home:  s.homeDir,
+		Shell: dftContainerShell,
+	}
+	groups := []*suser.Group{{GID: gid, Name: s.currentGroup, Users: []string{s.currentUser}}}
+	cred, err := suser.GetUserCredByUID(s.CurrentUID)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, id := range cred.Groups {
+		if id == gid {
+			continue
+		}
+		g, err := suser.LookupGroupID(id)
+		if err != nil {
+			s.logger().Warnf("lookup group %d failed: %v", id, err)
+			continue
+		}
+		groups = append(groups, &suser.Group{
+			GID: g.GID, Name: g.Name, Users: []string{s.currentUser}})
+	}
+	return u, groups, nil
+}
+
+// readImageFiles reads the files from a temporary container of image.
+func (s *Socker) readImageFiles(image string, files ...string) (map[string][]byte, error) {
+	output, err := su.Output(s.dockerUID, cmdDocker, "create",
+		"--label", fmt.Sprintf("%s=%s", labelOwner, s.CurrentUID),
+		"--entrypoint", "true", image)
+	if err != nil {
+		return nil, err
+	}
+	id := strings.TrimSpace(string(output))
+	defer func() {
+		if output, err := su.CombinedOutput(s.dockerUID, cmdDocker, "rm", "-f", id); err != nil {
+			s.logger().Errorf("remove container %s failed: %v:%s", id, err, output)
+		}
+	}()
+	contents := make(map[string][]byte)
+	for _, file := range files {
+		// docker cp writes a tar archive to stdout.
+		output, err := su.Output(s.dockerUID, cmdDocker, "cp", id+":"+file, "-")
+		if err != nil {
+			s.logger().Debugf("copy %s from image %s failed: %v", file, image, err)
+			continue
+		}
+		data, err := readTarFile(output)
+		if err != nil {
+			return nil, fmt.Errorf("read %s of image %s failed: %v", file, image, err)
+		}
+		contents[file] = data
+	}
+	return contents, nil
+}
+
+// readTarFile returns the content of the first regular file in the archive.
+func readTarFile(archive []byte) ([]byte, error) {
+	r := tar.NewReader(bytes.NewReader(archive))
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("no regular file in archive")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		if hdr.Size > maxAccountFile {
+			return nil, fmt.Errorf("file size %d exceeds %d", hdr.Size, maxAccountFile)
+		}
+		return ioutil.ReadAll(r)
+	}
+}
+
+// mergePasswd replaces the entries of image conflicting with user by name or
+// UID, and appends the user entry.
+func mergePasswd(data []byte, u *suser.User) []byte {
+	uid := strconv.Itoa(u.UID)
+	buf := &bytes.Buffer{}
+	lines := accountLines(data, rootPasswdEntry)
+	for _, line := range lines {
+		fields := strings.Split(line, sepColon)
+		if len(fields) > 2 && (fields[0] == u.Name || fields[2] == uid) {
+			continue
+		}
+		fmt.Fprintln(buf, line)
+	}
+	fmt.Fprintln(buf, u.PasswdEntry())
+	return buf.Bytes()
+}
+
+// mergeGroup replaces the entries of image conflicting with groups by name
+// or GID, and appends the groups entries.
+func mergeGroup(data []byte, groups []*suser.Group) []byte {
+	buf := &bytes.Buffer{}
+	lines := accountLines(data, rootGroupEntry)
+	for _, line := range lines {
+		fields := strings.Split(line, sepColon)
+		if len(fields) > 2 && isGroupConflicted(groups, fields[0], fields[2]) {
+			continue
+		}
+		fmt.Fprintln(buf, line)
+	}
+	for _, g := range groups {
+		fmt.Fprintln(buf, g.GroupEntry())
+	}
+	return buf.Bytes()
+}
+
+func isGroupConflicted(groups []*suser.Group, name, gid string) bool {
+	for _, g := range groups {
+		if g.Name == name || strconv.Itoa(g.GID) == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// accountLines returns the non-empty lines of account file, the root entry
+// is used if the image has no such file.
+func accountLines(data []byte, rootEntry string) []string {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return []string{rootEntry}
+	}
+	var lines []string
+	for _, line := range strings.Split(string(data), lineBrk) {
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
@@ -0,0 +1,121 @@
+// Copyright (c) 2018 China-HPC.
+
+package socker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	dftPolicyFile = "/var/lib/socker/socker.yaml"
+)
+
+// Policy represents the site-wide socker policy defined by administrators,
+// unlike Config it can't be changed by regular users.
+type Policy struct {
+	// WaiveUsernsRemap allows containers to run in secure mode while the
+	// Docker daemon has no userns-remap enabled.
+	WaiveUsernsRemap bool `yaml:"waive_userns_remap"`
+	// WritableMountPrefixes are the directories under which users can mount
+	// their own or writable directories without read-only.
+	WritableMountPrefixes []string `yaml:"writable_mount_prefixes"`
+	// DefaultMounts are mounted into every container in -v syntax, the
+	// variables such as ${USER} are substituted for current user.
+	DefaultMounts []string `yaml:"default_mounts"`
+	// VolumeDeepCheck bounds the check of files inside bind mounts.
+	VolumeDeepCheck VolumeDeepCheck `yaml:"volume_deep_check"`
+	// MaxTmpfsSize caps the size of tmpfs mounts, e.g. 512m.
+	MaxTmpfsSize string `yaml:"max_tmpfs_size"`
+	// JobScratch is the node-local scratch directory of Slurm jobs.
+	JobScratch JobScratch `yaml:"job_scratch"`
+	// Security is the security baseline of containers.
+	Security SecurityPolicy `yaml:"security"`
+	// Access restricts the usage of socker to groups.
+	Access Access `yaml:"access"`
+	// AuditFile is the JSON lines audit log of privileged actions, it is
+	// disabled if empty.
+	AuditFile string `yaml:"audit_file"`
+	// AuditMaxSize is the size the audit log is rotated at, e.g. 64m, it is
+	// never rotated if empty.
+	AuditMaxSize string `yaml:"audit_max_size"`
+	// Log defines the sinks of socker's own logs.
+	Log LogPolicy `yaml:"log"`
+	// Signals defines how signals are passed to containers.
+	Signals SignalPolicy `yaml:"signals"`
+	// AuthZ defines how the Docker authorization plugin treats requests.
+	AuthZ AuthZPolicy `yaml:"authz"`
+	// Limits are the resources of containers outside Slurm jobs, or inside
+	// the jobs whose cgroups are not found.
+	Limits ResourceLimits `yaml:"limits"`
+	// Confinement is strict or best-effort, a container that can't be
+	// confined in the cgroups of its Slurm job is stopped and removed in
+	// the strict mode.
+	Confinement string `yaml:"confinement"`
+}
+
+// VolumeDeepCheck represents the bounds of checking the files inside bind
+// mounts are readable by user, it is disabled if MaxEntries is zero.
+type VolumeDeepCheck struct {
+	// MaxEntries is the max number of files checked of each mount.
+	MaxEntries int `yaml:"max_entries"`
+	// MaxDepth is the max directory depth checked, zero means no limit.
+	MaxDepth int `yaml:"max_depth"`
+}
+
+// defaultPolicy returns the policy used when it is not defined by file.
+func defaultPolicy() *Policy {
+	return &Policy{
+		MaxTmpfsSize: dftMaxTmpfsSize,
+		AuditFile:    dftAuditFile,
+		AuditMaxSize: dftAuditMaxSize,
+		Confinement:  confinementStrict,
+		Signals: SignalPolicy{
+			Forward:     []string{"SIGHUP", "SIGQUIT", "SIGUSR1", "SIGUSR2", "SIGCONT"},
+			StopTimeout: dftStopTimeout,
+		},
+		JobScratch: JobScratch{
+			Base:   dftJobScratchBase,
+			Target: dftJobScratchTarget,
+		},
+		Security: SecurityPolicy{
+			NoNewPrivileges: true,
+			PidsLimit:       dftPidsLimit,
+		},
+	}
+}
+
+// loadPolicy loads policy from file, the default policy is used if the file
+// does not exist. The file must be owned by root and writable only by root.
+func loadPolicy(file string) (*Policy, error) {
+	policy := defaultPolicy()
+	info, err := os.Stat(file)
+	if os.IsNotExist(err) {
+		return policy, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || stat.Uid != 0 || info.Mode().Perm()&0022 != 0 {
+		return nil, fmt.Errorf("policy file %s must be owned and writable only by root", file)
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, policy); err != nil {
+		return nil, fmt.Errorf("parse policy file %s failed: %v", file, err)
+	}
+	if policy.Confinement != confinementStrict && policy.Confinement != confinementBestEffort {
+		return nil, fmt.Errorf("invalid confinement %q of policy file %s", policy.Confinement, file)
+	}
+	if _, err := policy.Limits.allocation(); err != nil {
+		return nil, fmt.Errorf("invalid limits of policy file %s: %v", file, err)
+	}
+	return policy, nil
+}
@@ -0,0 +1,274 @@
+// Copyright (c) 2018 China-HPC.
+
+package socker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// the memory limit of cgroup v1 is a huge number if it is unlimited.
+	maxMemoryLimit = 1 << 62
+	maxCPUID       = 1 << 16
+)
+
+// ResourceLimits represents the resources of containers defined by site
+// policy, they are not limited if empty.
+type ResourceLimits struct {
+	// CPUs is the number of CPUs.
+	CPUs int `yaml:"cpus"`
+	// Memory is the memory limit such as 4g.
+	Memory string `yaml:"memory"`
+}
+
+// allocation returns the limits as an allocation.
+func (l ResourceLimits) allocation() (*allocation, error) {
+	if l.CPUs < 0 {
+		return nil, fmt.Errorf("invalid cpus %d", l.CPUs)
+	}
+	alloc := &allocation{CPUs: l.CPUs}
+	if l.Memory != "" {
+		memory, err := parseSize(l.Memory)
+		if err != nil {
+			return nil, err
+		}
+		alloc.Memory = memory
+	}
+	return alloc, nil
+}
+
+// allocation is the resources allocated to the Slurm job on current node,
+// the empty fields are not allocated or unknown.
+type allocation struct {
+	// CPUs is the number of CPUs.
+	CPUs int
+	// Cpuset and Mems are the CPUs and memory nodes in the list format, e.g.
+	// 0-3,8.
+	Cpuset string
+	Mems   string
+	// Memory is the memory limit in bytes.
+	Memory int64
+}
+
+func (a *allocation) isEmpty() bool {
+	return a.CPUs == 0 && a.Cpuset == "" && a.Mems == "" && a.Memory == 0
+}
+
+// jobAllocation reads the allocation of current job from its cgroups, the
+// Slurm environment variables are defined by user and never trusted.
+func (s *Socker) jobAllocation() (*allocation, error) {
+	alloc := &allocation{}
+	cpuset := s.jobCgroupFile("cpuset", "cpuset.cpus", "cpuset.cpus.effective")
+	if cpuset != "" {
+		cpus, err := parseCPUList(cpuset)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cpuset of job: %v", err)
+		}
+		alloc.Cpuset = cpuset
+		alloc.CPUs = len(cpus)
+	}
+	alloc.Mems = s.jobCgroupFile("cpuset", "cpuset.mems", "cpuset.mems.effective")
+	if limit := s.jobCgroupFile("memory", "memory.limit_in_bytes", "memory.max"); limit != "" && limit != "max" {
+		memory, err := strconv.ParseInt(limit, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid memory limit of job: %v", err)
+		}
+		if memory < maxMemoryLimit {
+			alloc.Memory = memory
+		}
+	}
+	return alloc, nil
+}
+
+// jobCgroupFile reads the file of the job cgroup in the hierarchy of cgroup
+// v1 with the name v1, or in the unified hierarchy with the name v2, it is
+// empty if not found.
+func (s *Socker) jobCgroupFile(subsystem, v1, v2 string) string {
+	if !jobIDPattern.MatchString(s.slurmJobID) {
+		return ""
+	}
+	job := "job_" + s.slurmJobID
+	patterns := []string{
+		path.Join(cgroupRoot, subsystem, "slurm*", "uid_"+s.CurrentUID, job, v1),
+		path.Join(cgroupRoot, "system.slice", "slurmstepd.scope", job, v2),
+	}
+	for _, pattern := range patterns {
+		matches, _ := filepath.Glob(pattern)
+		for _, match := range matches {
+			data, err := ioutil.ReadFile(match)
+			if err != nil {
+				s.logger().Debugf("read %s failed: %v", match, err)
+				continue
+			}
+			if value := strings.TrimSpace(string(data)); value != "" {
+				return value
+			}
+		}
+	}
+	return ""
+}
+
+// limitResources sets the resource options of the container to the
+// allocation of the job, the options requested by user must be within it.
+// The limits of site policy are used outside jobs, or if the cgroups of the
+// job are not found.
+func (s *Socker) limitResources(opts *Opts) error {
+	alloc := &allocation{}
+	var err error
+	if s.isInsideJob {
+		if alloc, err = s.jobAllocation(); err != nil {
+			return failed(err)
+		}
+	}
+	if alloc.isEmpty() {
+		if alloc, err = s.policy.Limits.allocation(); err != nil {
+			return failed(fmt.Errorf("invalid limits of policy: %v", err))
+		}
+		if alloc.isEmpty() && s.isInsideJob {
+			return fmt.Errorf("the cgroups of job %s are not found and no limits are defined by site policy",
+				s.slurmJobID)
+		}
+	}
+	s.logger().Debugf("allocation: %+v", alloc)
+	if alloc.CPUs > 0 {
+		if opts.CPUs != "" {
+			cpus, err := strconv.ParseFloat(opts.CPUs, 64)
+			if err != nil || cpus <= 0 {
+				return fmt.Errorf("invalid --cpus %s", opts.CPUs)
+			}
+			if cpus > float64(alloc.CPUs) {
+				return fmt.Errorf("--cpus exceeds the %d CPUs allocated", alloc.CPUs)
+			}
+		} else {
+			opts.CPUs = strconv.Itoa(alloc.CPUs)
+		}
+	}
+	if opts.CpusetCPUs, err = limitCPUList("--cpuset-cpus", opts.CpusetCPUs, alloc.Cpuset); err != nil {
+		return err
+	}
+	if opts.CpusetMems, err = limitCPUList("--cpuset-mems", opts.CpusetMems, alloc.Mems); err != nil {
+		return err
+	}
+	if alloc.Memory > 0 {
+		memory := alloc.Memory
+		if opts.Memory != "" {
+			if memory, err = parseSize(opts.Memory); err != nil || memory <= 0 {
+				return fmt.Errorf("invalid --memory %s", opts.Memory)
+			}
+			if memory > alloc.Memory {
+				return fmt.Errorf("--memory exceeds the %d bytes allocated", alloc.Memory)
+			}
+		}
+		opts.Memory = strconv.FormatInt(memory, 10)
+		// swap is not allocated, the memory and swap is capped by the memory
+		// limit.
+		if opts.MemorySwap != "" {
+			swap, err := parseSize(opts.MemorySwap)
+			if err != nil || swap != memory {
+				return fmt.Errorf("--memory-swap must be the same as --memory")
+			}
+		}
+		opts.MemorySwap = opts.Memory
+	}
+	return nil
+}
+
+// limitCPUList returns the list requested by user if it is a subset of the
+// allocated list, or the allocated list if it is not requested.
+func limitCPUList(flag, requested, allocated string) (string, error) {
+	if allocated == "" {
+		return requested, nil
+	}
+	if requested == "" {
+		return allocated, nil
+	}
+	list, err := parseCPUList(requested)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s: %v", flag, err)
+	}
+	allowed, err := parseCPUList(allocated)
+	if err != nil {
+		return "", err
+	}
+	for id := range list {
+		if !allowed[id] {
+			return "", fmt.Errorf("%s %s is not within %s allocated",
+				flag, requested, allocated)
+		}
+	}
+	return requested, nil
+}
+
+// parseCPUList parses the list format of cpuset such as 0-3,8,10-11.
+func parseCPUList(list string) (map[int]bool, error) {
+	ids := map[int]bool{}
+	for _, item := range strings.Split(strings.TrimSpace(list), ",") {
+		bounds := strings.SplitN(item, "-", 2)
+		start, err := strconv.Atoi(bounds[0])
+		if err != nil || start < 0 || start >= maxCPUID {
+			return nil, fmt.Errorf("invalid cpu list %s", list)
+		}
+		end := start
+		if len(bounds) == 2 {
+			if end, err = strconv.Atoi(bounds[1]); err != nil || end < start || end >= maxCPUID {
+				return nil, fmt.Errorf("invalid cpu list %s", list)
+			}
+		}
+		for id := start; id <= end; id++ {
+			ids[id] = true
+		}
+	}
+	return ids, nil
+}
+
+// jobCgroupPattern matches the cgroup paths of Slurm jobs in both cgroup v1
+// and v2, e.g. "/slurm/uid_1000/job_42/step_0".
+var jobCgroupPattern = regexp.MustCompile(`/job_([0-9]+)(/|$)`)
+
+// verifyJob checks the job id is the job whose cgroups the caller process is
+// in, the job ids of environment are defined by user.
+func (s *Socker) verifyJob(jobID string) error {
+	if !jobIDPattern.MatchString(jobID) {
+		return fmt.Errorf("invalid job id")
+	}
+	// the client of daemon is the caller, otherwise socker itself which
+	// inherits the cgroups of the user's shell.
+	pid := os.Getpid()
+	if s.clientPID > 0 {
+		pid = s.clientPID
+	}
+	data, err := ioutil.ReadFile(path.Join(procRoot, strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return fmt.Errorf("read cgroups of process %d failed: %v", pid, err)
+	}
+	job := cgroupJobID(string(data))
+	if job == "" {
+		return fmt.Errorf("the caller is not in the cgroups of a Slurm job")
+	}
+	if job != jobID {
+		return fmt.Errorf("the caller runs in job %s", job)
+	}
+	return nil
+}
+
+// cgroupJobID returns the id of Slurm job in the content of /proc/<pid>/cgroup,
+// it is empty if the process is not in the cgroups of a job.
+func cgroupJobID(data string) string {
+	for _, line := range strings.Split(strings.TrimSpace(data), lineBrk) {
+		fields := strings.SplitN(line, sepColon, 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if m := jobCgroupPattern.FindStringSubmatch(fields[2]); m != nil {
+			return m[1]
+		}
+	}
+	return ""
+}
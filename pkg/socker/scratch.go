@@ -0,0 +1,102 @@
+// Copyright (c) 2018 China-HPC.
+
+package socker
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	dftJobScratchBase   = "/tmp/socker"
+	dftJobScratchTarget = "/scratch/job"
+	permJobScratchBase  = 0755
+	permJobScratch      = 0700
+)
+
+var jobIDPattern = regexp.MustCompile(`^[0-9]+$`)
+
+// JobScratch represents the node-local scratch directories of Slurm jobs,
+// they are removed by the epilog when the job terminated.
+type JobScratch struct {
+	// Base is the directory where the job scratch directories are created,
+	// the job scratch is disabled if it is empty.
+	Base string `yaml:"base"`
+	// Target is the path where the job scratch is mounted in containers.
+	Target string `yaml:"target"`
+}
+
+// prepareJobScratch creates the scratch directory of current job owned by
+// current user, grants the remapped ids of container access to it like the
+// swap directory, and returns its path.
+func (s *Socker) prepareJobScratch(asUser bool) (string, error) {
+	scratch := s.policy.JobScratch
+	if !jobIDPattern.MatchString(s.slurmJobID) {
+		return "", fmt.Errorf("invalid job id %s", s.slurmJobID)
+	}
+	uid, err := strconv.Atoi(s.CurrentUID)
+	if err != nil {
+		return "", err
+	}
+	gid, err := strconv.Atoi(s.currentGID)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(scratch.Base, permJobScratchBase); err != nil {
+		return "", err
+	}
+	// the base is usually in world writable /tmp, it must not be a symlink
+	// or be created by regular users.
+	baseFd, err := unix.Open(scratch.Base,
+		unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return "", fmt.Errorf("open %s failed: %v", scratch.Base, err)
+	}
+	defer unix.Close(baseFd)
+	stat := &unix.Stat_t{}
+	if err := unix.Fstat(baseFd, stat); err != nil {
+		return "", err
+	}
+	if stat.Uid != 0 || stat.Mode&0022 != 0 {
+		return "", fmt.Errorf("%s must be owned and writable only by root", scratch.Base)
+	}
+	err = unix.Mkdirat(baseFd, s.slurmJobID, permJobScratch)
+	if err != nil && err != unix.EEXIST {
+		return "", err
+	}
+	fd, err := unix.Openat(baseFd, s.slurmJobID,
+		unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return "", err
+	}
+	dirPath := path.Join(scratch.Base, s.slurmJobID)
+	dir := os.NewFile(uintptr(fd), dirPath)
+	defer dir.Close()
+	if err := unix.Fstat(fd, stat); err != nil {
+		return "", err
+	}
+	if int(stat.Uid) != uid && stat.Uid != 0 {
+		return "", fmt.Errorf("%s is not owned by %s", dirPath, s.currentUser)
+	}
+	if int(stat.Uid) != uid || int(stat.Gid) != gid {
+		if err := dir.Chown(uid, gid); err != nil {
+			return "", err
+		}
+	}
+	if s.remap != nil {
+		entries, err := s.remapACL("rwx", uid, gid, asUser, true)
+		if err != nil {
+			return "", err
+		}
+		if err := ensureACL(dir, entries...); err != nil {
+			return "", err
+		}
+	}
+	s.logger().Debugf("job scratch directory: %s", dirPath)
+	return dirPath, nil
+}
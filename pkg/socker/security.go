@@ -0,0 +1,131 @@
+// Copyright (c) 2018 China-HPC.
+
+package socker
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	capAll = "ALL"
+	// dftPidsLimit is the default max number of processes in a container.
+	dftPidsLimit = 4096
+)
+
+// SecurityPolicy represents the baseline security options of containers,
+// all capabilities are dropped except the ones added by policy.
+type SecurityPolicy struct {
+	// NoNewPrivileges prevents container processes from gaining privileges.
+	NoNewPrivileges bool `yaml:"no_new_privileges"`
+	// CapAdd are the capabilities added to every container.
+	CapAdd []string `yaml:"cap_add"`
+	// AllowedCapAdd are the capabilities users can add by --cap-add.
+	AllowedCapAdd []string `yaml:"allowed_cap_add"`
+	// SeccompProfile is the seccomp profile path, Docker default profile is
+	// used if it is empty.
+	SeccompProfile string `yaml:"seccomp_profile"`
+	// PidsLimit limits the number of processes, zero means no limit.
+	PidsLimit int `yaml:"pids_limit"`
+	// AllowedRuntimes are the OCI runtimes users can choose by --runtime,
+	// the default runtime of Docker is always allowed.
+	AllowedRuntimes []string `yaml:"allowed_runtimes"`
+}
+
+// securityArgs returns the docker run options of the security baseline.
+func (s *Socker) securityArgs(opts *Opts) []string {
+	sec := s.policy.Security
+	args := []string{"--cap-drop", capAll}
+	for _, c := range sec.CapAdd {
+		args = append(args, "--cap-add", normalizeCap(c))
+	}
+	if sec.NoNewPrivileges {
+		args = append(args, "--security-opt", "no-new-privileges")
+	}
+	if sec.SeccompProfile != "" {
+		args = append(args, "--security-opt",
+			fmt.Sprintf("seccomp=%s", sec.SeccompProfile))
+	}
+	// the lower limit specified by user takes effect instead.
+	if sec.PidsLimit > 0 && opts.PidsLimit == "" {
+		args = append(args, "--pids-limit", strconv.Itoa(sec.PidsLimit))
+	}
+	return args
+}
+
+// isSecurityPermit refuses the options which weaken the security baseline.
+func (s *Socker) isSecurityPermit(opts *Opts) error {
+	if opts.Privileged {
+		return fmt.Errorf("privileged container is not permitted")
+	}
+	for name, mode := range map[string]string{
+		"pid":    opts.Pid,
+		"ipc":    opts.IPC,
+		"userns": opts.Userns,
+		"uts":    opts.UTS,
+	} {
+		// joining the namespaces of other containers is refused too, they
+		// may belong to other users.
+		if mode == nsHost || strings.HasPrefix(mode, "container:") {
+			return fmt.Errorf("--%s=%s is not permitted", name, mode)
+		}
+	}
+	if strings.HasPrefix(opts.Network, "container:") {
+		return fmt.Errorf("--network=%s is not permitted", opts.Network)
+	}
+	if len(opts.SecurityOpt) != 0 {
+		return fmt.Errorf("--security-opt is not permitted, it is defined by site policy")
+	}
+	if err := s.isRuntimePermit(opts.Runtime); err != nil {
+		return err
+	}
+	if err := s.isCapAddPermit(opts.CapAdd); err != nil {
+		return err
+	}
+	if opts.PidsLimit != "" {
+		limit, err := strconv.Atoi(opts.PidsLimit)
+		if err != nil {
+			return fmt.Errorf("invalid --pids-limit: %v", err)
+		}
+		max := s.policy.Security.PidsLimit
+		if max > 0 && (limit <= 0 || limit > max) {
+			return fmt.Errorf("--pids-limit must be between 1 and %d", max)
+		}
+	}
+	return nil
+}
+
+// isRuntimePermit checks the runtime is allowed by policy.
+func (s *Socker) isRuntimePermit(runtime string) error {
+	if runtime == "" {
+		return nil
+	}
+	for _, allowed := range s.policy.Security.AllowedRuntimes {
+		if runtime == allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("runtime %s is not permitted", runtime)
+}
+
+// isCapAddPermit checks the capabilities are allowed by policy.
+func (s *Socker) isCapAddPermit(caps []string) error {
+	sec := s.policy.Security
+	allowed := make(map[string]bool)
+	for _, c := range append(sec.CapAdd, sec.AllowedCapAdd...) {
+		allowed[normalizeCap(c)] = true
+	}
+	for _, c := range caps {
+		if !allowed[normalizeCap(c)] {
+			return fmt.Errorf("capability %s is not permitted", c)
+		}
+	}
+	return nil
+}
+
+// normalizeCap formats capability name as Docker does, e.g. cap_net_raw is
+// formatted as NET_RAW.
+func normalizeCap(c string) string {
+	return strings.TrimPrefix(strings.ToUpper(c), "CAP_")
+}
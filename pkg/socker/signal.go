@@ -0,0 +1,150 @@
+// Copyright (c) 2018 China-HPC.
+
+package socker
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/China-HPC/go-socker/pkg/su"
+)
+
+const dftStopTimeout = 10
+
+// signalNames are the signals can be forwarded to containers.
+var signalNames = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+	"SIGTERM": syscall.SIGTERM,
+	"SIGCONT": syscall.SIGCONT,
+}
+
+// stopSignals are the signals terminate socker, they stop the container
+// gracefully instead of being forwarded.
+var stopSignals = []os.Signal{syscall.SIGTERM, syscall.SIGINT}
+
+// SignalPolicy defines how the signals socker receives, e.g. sent by Slurm
+// when the job is cancelled or preempted, are passed to containers.
+type SignalPolicy struct {
+	// Forward are the signals forwarded to the init process of container.
+	Forward []string `yaml:"forward"`
+	// StopTimeout is the seconds docker stop waits before killing the
+	// container when socker is terminated by SIGTERM or SIGINT.
+	StopTimeout int `yaml:"stop_timeout"`
+}
+
+// parseSignal parses the signal name such as SIGUSR1 or USR1.
+func parseSignal(name string) (syscall.Signal, error) {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	sig, ok := signalNames[name]
+	if !ok {
+		return 0, fmt.Errorf("signal %s can't be forwarded", name)
+	}
+	return sig, nil
+}
+
+// forwardSignals forwards the signals to the container until the returned
+// function is called, which also stops the container, so the container never
+// outlives socker.
+func (s *Socker) forwardSignals(container string) func() {
+	forward := make(map[os.Signal]bool)
+	for _, name := range s.policy.Signals.Forward {
+		sig, err := parseSignal(name)
+		if err != nil {
+			s.logger().Warnf("invalid signal of policy: %v", err)
+			continue
+		}
+		forward[sig] = true
+	}
+	signals := s.streams.Signals
+	var notified chan os.Signal
+	if signals == nil {
+		notified = make(chan os.Signal, len(signalNames))
+		watched := append([]os.Signal(nil), stopSignals...)
+		for sig := range forward {
+			watched = append(watched, sig)
+		}
+		signal.Notify(notified, watched...)
+		signals = notified
+	}
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig, ok := <-signals:
+				if !ok {
+					return
+				}
+				if isStopSignal(sig) {
+					s.logger().Infof("received %v, stop container %s", sig, container)
+					s.stopContainer(container)
+				} else if forward[sig] {
+					s.killContainer(container, sig)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		if notified != nil {
+			signal.Stop(notified)
+		}
+		close(done)
+		s.stopContainer(container)
+	}
+}
+
+func isStopSignal(sig os.Signal) bool {
+	for _, stop := range stopSignals {
+		if sig == stop {
+			return true
+		}
+	}
+	return false
+}
+
+// stopContainer stops the container with the grace period of policy, it is
+// a no-op if the container has exited or been removed.
+func (s *Socker) stopContainer(container string) {
+	timeout := s.policy.Signals.StopTimeout
+	output, err := su.CombinedOutput(s.dockerUID, cmdDocker, "stop",
+		"--time", strconv.Itoa(timeout), container)
+	if err != nil {
+		s.logger().Debugf("stop container %s: %v:%s", container, err, output)
+	}
+}
+
+// removeContainer stops the container gracefully and removes it.
+func (s *Socker) removeContainer(container string) {
+	s.stopContainer(container)
+	output, err := su.CombinedOutput(s.dockerUID, cmdDocker, "rm", "--force",
+		"--volumes", container)
+	if err != nil {
+		s.logger().Debugf("remove container %s: %v:%s", container, err, output)
+	}
+}
+
+// killContainer sends the signal to the init process of the container.
+func (s *Socker) killContainer(container string, sig os.Signal) {
+	num, ok := sig.(syscall.Signal)
+	if !ok {
+		return
+	}
+	s.logger().Debugf("forward %v to container %s", sig, container)
+	output, err := su.CombinedOutput(s.dockerUID, cmdDocker, "kill",
+		"--signal", strconv.Itoa(int(num)), container)
+	if err != nil {
+		s.logger().Errorf("forward %v to container %s failed: %v:%s", sig, container, err, output)
+	}
+}
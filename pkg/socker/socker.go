@@ -4,43 +4,47 @@
 package socker
 
 import (
-	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"os/signal"
-	"os/user"
 	"path"
-	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/China-HPC/go-socker/pkg/su"
+	suser "github.com/China-HPC/go-socker/pkg/user"
 	log "github.com/Sirupsen/logrus"
 	flags "github.com/jessevdk/go-flags"
 	"github.com/kr/pty"
 	uuid "github.com/satori/go.uuid"
 	"github.com/urfave/cli"
 	"golang.org/x/crypto/ssh/terminal"
-	"golang.org/x/sys/unix"
 	yaml "gopkg.in/yaml.v2"
 )
 
 const (
-	cmdDocker     = "docker"
 	cmdCgclassify = "cgclassify"
 	cmdPs         = "ps"
 	cmdPgrep      = "pgrep"
+	cmdGetfacl    = "getfacl"
+	cmdSetfacl    = "setfacl"
 	sepColon      = ":"
 	sepPipe       = "|"
 	lineBrk       = "\n"
 	envSlurmJobID = "SLURM_JOBID"
+	labelPrefix   = "org.china-hpc.socker."
+	labelOwner    = labelPrefix + "uid"
+	labelJob      = labelPrefix + "job"
 
 	containerRunTimeout = time.Second * 30
-	epilogDir           = "/var/lib/socker/epilog"
+	dockerUser          = "dockerroot"
 	permEpilogDir       = 0700
 	permRecordFile      = 0600
 
@@ -48,6 +52,18 @@ const (
 	layoutImageFormat  = `{{.ID}}|{{.Repository}}|{{.Tag}}|{{.CreatedSince}}|{{.CreatedAt}}|{{.Size}}`
 )
 
+// cmdDocker is the trusted path of docker, it is never looked up in PATH as
+// socker runs with setuid.
+var cmdDocker = "/usr/bin/docker"
+
+// trustedCommandDirs are the trusted locations of the other commands run by
+// socker, such as cgclassify and pgrep.
+var trustedCommandDirs = []string{"/usr/bin", "/bin"}
+
+// epilogDir keeps the owner records of containers and the job records of
+// the epilog.
+var epilogDir = "/var/lib/socker/epilog"
+
 // Socker provides a runner for docker.
 type Socker struct {
 	dockerUID     string
@@ -60,19 +76,58 @@ type Socker struct {
 	containerUUID string
 	isInsideJob   bool
 	slurmJobID    string
+	environ       []string
+	streams       *Streams
+	policy        *Policy
+	remap         *remapRanges
+	remapErr      error
+	// userns caches the detection of userns-remap, the callers of daemon
+	// share it.
+	userns *usernsCache
+	// binds are the checked bind sources held open until the run returns,
+	// keyed by the path docker mounts them by.
+	binds map[string]*boundSource
+	// clientPID is the process of the client if socker runs as daemon.
+	clientPID int
+	// rootStarted is true if the socker process is started by root, e.g. the
+	// daemon, the callers it acts on behalf of don't matter.
+	rootStarted bool
+	// serving is true if socker serves as daemon, the logs of its callers
+	// carry their own fields.
+	serving bool
 	*Config
 }
 
+// Streams represents the standard streams a socker command attached to.
+type Streams struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+	// Resize receives the terminal size changes of a remote client, it is nil
+	// when socker is attached to the local terminal.
+	Resize <-chan *pty.Winsize
+	// Signals receives the signals sent to a remote client, the signals of
+	// socker process are handled if it is nil.
+	Signals <-chan os.Signal
+	// Hangup is closed when the remote client is disconnected, e.g. killed.
+	Hangup <-chan struct{}
+}
+
 // Config represents the socker configurations.
 type Config struct {
 	Verbose       bool
 	EpilogEnabled bool
 	Insecure      bool
+	// BestEffort keeps the container running if it can't be confined in the
+	// job cgroups, it is allowed only if socker is started by root.
+	BestEffort bool
 }
 
 // Opts represents the socker supported docker options.
 type Opts struct {
 	Volumes     []string `short:"v" long:"volume"`
+	Mounts      []string `long:"mount"`
+	Tmpfs       []string `long:"tmpfs"`
 	TTY         bool     `short:"t" long:"tty"`
 	Interactive bool     `short:"i" long:"interactive"`
 	Detach      bool     `short:"d" long:"detach"`
@@ -83,6 +138,20 @@ type Opts struct {
 	User        string   `short:"u" long:"user"`
 	StorageOpt  string   `long:"storage-opt"`
 	ShmSize     string   `long:"shm-size"`
+	Privileged  bool     `long:"privileged"`
+	Pid         string   `long:"pid"`
+	IPC         string   `long:"ipc"`
+	Userns      string   `long:"userns"`
+	UTS         string   `long:"uts"`
+	CapAdd      []string `long:"cap-add"`
+	CapDrop     []string `long:"cap-drop"`
+	SecurityOpt []string `long:"security-opt"`
+	PidsLimit   string   `long:"pids-limit"`
+	CPUs        string   `long:"cpus"`
+	CpusetCPUs  string   `long:"cpuset-cpus"`
+	CpusetMems  string   `long:"cpuset-mems"`
+	Memory      string   `short:"m" long:"memory"`
+	MemorySwap  string   `long:"memory-swap"`
 }
 
 // ExecOpts represents the socker supported docker exec options.
@@ -93,14 +162,41 @@ type ExecOpts struct {
 	User        string `short:"u" long:"user"`
 }
 
+// PsOpts represents the socker supported docker ps options.
+type PsOpts struct {
+	All   bool `short:"a" long:"all"`
+	Quiet bool `short:"q" long:"quiet"`
+}
+
+// LogsOpts represents the socker supported docker logs options.
+type LogsOpts struct {
+	Follow     bool   `short:"f" long:"follow"`
+	Tail       string `long:"tail"`
+	Since      string `long:"since"`
+	Timestamps bool   `short:"t" long:"timestamps"`
+}
+
+// StopOpts represents the socker supported docker stop options.
+type StopOpts struct {
+	Time string `short:"t" long:"time"`
+}
+
 // New creates a socker instance.
 func New(conf *Config) (*Socker, error) {
 	if conf.Verbose {
 		log.SetLevel(log.DebugLevel)
 	}
-	log.SetOutput(os.Stdout)
+	// the logs must not interleave with the output of containers.
+	log.SetOutput(os.Stderr)
 	s := &Socker{
-		Config: conf,
+		Config:      conf,
+		rootStarted: os.Getuid() == 0,
+		userns:      &usernsCache{},
+		streams: &Streams{
+			Stdin:  os.Stdin,
+			Stdout: os.Stdout,
+			Stderr: os.Stderr,
+		},
 	}
 	err := s.checkPrerequisite()
 	if err != nil {
@@ -109,6 +205,29 @@ func New(conf *Config) (*Socker, error) {
 	return s, nil
 }
 
+// ForCaller returns a copy of socker which acts on behalf of the user with
+// specified uid, pid is the caller process, environ is the caller's
+// environment and streams are the caller's standard streams.
+func (s *Socker) ForCaller(uid uint32, pid int, environ []string, streams *Streams) (*Socker, error) {
+	cred, err := suser.GetUserCredByUID(strconv.FormatUint(uint64(uid), 10))
+	if err != nil {
+		return nil, fmt.Errorf("can't get caller user info: %v", err)
+	}
+	if err := cred.Validate(); err != nil {
+		return nil, err
+	}
+	caller := *s
+	caller.containerUUID = ""
+	caller.streams = streams
+	// the containers run by the client are tied to it rather than the
+	// daemon, and its job is verified by its cgroups.
+	caller.clientPID = pid
+	if err := caller.setCaller(cred.User, environ); err != nil {
+		return nil, err
+	}
+	return &caller, nil
+}
+
 // Image represents the socker/socker availible image format
 type Image struct {
 	ID            string `yaml:"id"`
@@ -118,6 +237,9 @@ type Image struct {
 	CreatedScince string `yaml:"created_since"`
 	CreatedAt     string `yaml:"created_at"`
 	Size          string `yaml:"size"`
+	// SkipDefaultMounts are the targets of site default mounts which are not
+	// mounted into this image, "*" skips all of them.
+	SkipDefaultMounts []string `yaml:"skip_default_mounts,omitempty"`
 }
 
 // FormatImages lists all available images from registry by map.
@@ -149,32 +271,53 @@ func (s *Socker) PrintImages(config string) error {
 	return nil
 }
 
-// SyncImages syncs available images for CLI.
+// SyncImages syncs available images for CLI, the users delegated by site
+// policy can only sync the default images config.
 func (s *Socker) SyncImages(configFile, repoFilter, filter string) error {
 	if configFile == "" {
 		configFile = dftImageConfigFile
 	}
-	images, err := ParseImages(repoFilter, filter)
+	rec := s.newAuditRecord("images sync",
+		[]string{"--config", configFile, "--repo", repoFilter, "--filter", filter})
+	// the config is written as root, a path chosen by users could overwrite
+	// any file.
+	if s.CurrentUID != "0" && path.Clean(configFile) != dftImageConfigFile {
+		err := fmt.Errorf("only root can sync images to %s", configFile)
+		s.auditDenial(rec, err)
+		return denied(err)
+	}
+	if err := s.audit(rec, decisionAllow, nil); err != nil {
+		return fmt.Errorf("write audit log failed: %v", err)
+	}
+	images, err := s.ParseImages(repoFilter, filter)
 	if err != nil {
 		return err
 	}
+	// keep the settings defined by administrators of the synced images.
+	if existed, err := loadImages(configFile); err == nil {
+		for name, image := range images {
+			image.Desc = existed[name].Desc
+			image.SkipDefaultMounts = existed[name].SkipDefaultMounts
+			images[name] = image
+		}
+	}
 	data, err := yaml.Marshal(images)
 	if err != nil {
-		log.Errorf("marshal yaml data failed: %v", err)
+		s.logger().Errorf("marshal yaml data failed: %v", err)
 		return err
 	}
 	return ioutil.WriteFile(configFile, data, permRecordFile)
 }
 
 // ParseImages parses images from docker.
-func ParseImages(repoFilter, filter string) (map[string]Image, error) {
+func (s *Socker) ParseImages(repoFilter, filter string) (map[string]Image, error) {
 	args := []string{"images", "--format", layoutImageFormat}
 	if filter != "" {
 		args = append(args, fmt.Sprintf("--filter=%s", filter))
 	}
-	out, err := exec.Command(cmdDocker, args...).CombinedOutput()
+	out, err := su.CombinedOutput(s.dockerUID, cmdDocker, args...)
 	if err != nil {
-		log.Errorf("list images from Docker failed: %v:%s", err, out)
+		s.logger().Errorf("list images from Docker failed: %v", err)
 		return nil, err
 	}
 	images := make(map[string]Image)
@@ -182,7 +325,7 @@ func ParseImages(repoFilter, filter string) (map[string]Image, error) {
 		TrimSpace(string(out)), lineBrk) {
 		image, err := parseImage(line)
 		if err != nil {
-			log.Errorf("parse image failed: %v", err)
+			s.logger().Errorf("parse image failed: %v", err)
 			return nil, err
 		}
 		if repoFilter == "" {
@@ -211,6 +354,36 @@ func parseImage(text string) (*Image, error) {
 	}, nil
 }
 
+// loadImages loads the images defined in socker image config.
+func loadImages(config string) (map[string]Image, error) {
+	data, err := listImagesData(config)
+	if err != nil {
+		return nil, fmt.Errorf("load image config failed: %v", err)
+	}
+	var images map[string]Image
+	if err := yaml.Unmarshal(data, &images); err != nil {
+		return nil, fmt.Errorf("parse image config failed: %v", err)
+	}
+	return images, nil
+}
+
+// findImage finds the image by name or ID, the tag is latest if omitted.
+func findImage(images map[string]Image, name string) (*Image, bool) {
+	if image, ok := images[name]; ok {
+		return &image, true
+	}
+	if image, ok := images[name+":latest"]; ok {
+		return &image, true
+	}
+	id := strings.TrimPrefix(name, "sha256:")
+	for _, image := range images {
+		if id != "" && strings.HasPrefix(strings.TrimPrefix(image.ID, "sha256:"), id) {
+			return &image, true
+		}
+	}
+	return nil, false
+}
+
 func listImagesData(config string) ([]byte, error) {
 	if config == "" {
 		config = dftImageConfigFile
@@ -249,25 +422,41 @@ func listImagesData(config string) ([]byte, error) {
 
 // Exec runs a command in a running container as regular user.
 func (s *Socker) Exec(command []string) error {
+	rec := s.newAuditRecord("exec", command)
+	return s.commandResult(rec, s.runExec(command, rec))
+}
+
+// commandResult returns the error of an audited command. The errors before
+// the command is allowed are refusals, which are audited as denials, unless
+// socker failed to prepare the command.
+func (s *Socker) commandResult(rec *AuditRecord, err error) error {
+	if err == nil || rec.Decision != "" || ExitCode(err) == ExitCodeError {
+		return commandError(err)
+	}
+	s.auditDenial(rec, err)
+	return denied(err)
+}
+
+func (s *Socker) runExec(command []string, rec *AuditRecord) error {
 	opts := ExecOpts{}
-	remainedArgs, err := flags.ParseArgs(&opts, command)
+	remainedArgs, err := parseArgs(&opts, command)
 	if err != nil {
-		log.Errorf("parse command args failed: %v", err)
+		s.logger().Errorf("parse command args failed: %v", err)
 		return err
 	}
 	if len(remainedArgs) < 2 {
 		return fmt.Errorf("you must specifiy container name and command")
 	}
-	containerUID, err := ioutil.ReadFile(path.Join(epilogDir, remainedArgs[0]))
-	if err != nil {
-		return fmt.Errorf("container owner check error: %v", err)
+	rec.Container = remainedArgs[0]
+	if err := s.checkOwner(remainedArgs[0]); err != nil {
+		return err
 	}
-	if strings.TrimSpace(string(containerUID)) != s.CurrentUID {
-		return fmt.Errorf("you have no permission to exec command in this container")
+	if err := s.audit(rec, decisionAllow, nil); err != nil {
+		return fmt.Errorf("write audit log failed: %v", err)
 	}
 	args := []string{"exec"}
 	args = append(args, command...)
-	log.Debugf("docker exec args: %v", args)
+	s.logger().Debugf("docker exec args: %v", args)
 	cmd, err := su.Command(s.dockerUID, cmdDocker, args...)
 	if err != nil {
 		return err
@@ -275,217 +464,540 @@ func (s *Socker) Exec(command []string) error {
 	if opts.TTY {
 		return s.runWithPty(cmd)
 	}
-	output, err := cmd.CombinedOutput()
+	return s.runAttached(cmd, opts.Interactive)
+}
+
+// Ps lists containers which are owned by current user.
+func (s *Socker) Ps(command []string) error {
+	opts := PsOpts{}
+	remainedArgs, err := parseArgs(&opts, command)
 	if err != nil {
+		s.logger().Errorf("parse command args failed: %v", err)
 		return err
 	}
-	fmt.Fprintf(os.Stdout, "%s", output)
+	if len(remainedArgs) != 0 {
+		return fmt.Errorf("unexpected arguments: %v", remainedArgs)
+	}
+	args := []string{"ps", "--filter",
+		fmt.Sprintf("label=%s=%s", labelOwner, s.CurrentUID)}
+	if opts.All {
+		args = append(args, "--all")
+	}
+	if opts.Quiet {
+		args = append(args, "--quiet")
+	}
+	return s.runDocker(args...)
+}
+
+// Logs fetches the logs of a container which is owned by current user.
+func (s *Socker) Logs(command []string) error {
+	opts := LogsOpts{}
+	remainedArgs, err := parseArgs(&opts, command)
+	if err != nil {
+		s.logger().Errorf("parse command args failed: %v", err)
+		return err
+	}
+	if len(remainedArgs) != 1 {
+		return fmt.Errorf("you must specifiy exactly one container name")
+	}
+	if err := s.checkOwner(remainedArgs[0]); err != nil {
+		return denied(err)
+	}
+	args := []string{"logs"}
+	args = append(args, command...)
+	return s.runDocker(args...)
+}
+
+// Stop stops containers which are owned by current user.
+func (s *Socker) Stop(command []string) error {
+	opts := StopOpts{}
+	remainedArgs, err := parseArgs(&opts, command)
+	if err != nil {
+		s.logger().Errorf("parse command args failed: %v", err)
+		return err
+	}
+	if len(remainedArgs) == 0 {
+		return fmt.Errorf("you must specifiy at least one container name")
+	}
+	for _, name := range remainedArgs {
+		if err := s.checkOwner(name); err != nil {
+			return denied(err)
+		}
+	}
+	args := []string{"stop"}
+	args = append(args, command...)
+	return s.runDocker(args...)
+}
+
+// checkOwner checks whether the container is created by current user.
+func (s *Socker) checkOwner(containerName string) error {
+	containerUID, err := ioutil.ReadFile(path.Join(epilogDir, containerName))
+	if err != nil {
+		return fmt.Errorf("container owner check error: %v", err)
+	}
+	if strings.TrimSpace(string(containerUID)) != s.CurrentUID {
+		return fmt.Errorf("you have no permission to access this container")
+	}
 	return nil
 }
 
+// reserveOwner reserves the owner record of the container before it is
+// created, the record is empty until it is committed, so the container is not
+// accessible to anyone. reserved is false if the record of current user is
+// reused, the names recorded for others are refused.
+func (s *Socker) reserveOwner(containerName string) (reserved bool, err error) {
+	f, err := os.OpenFile(path.Join(epilogDir, containerName),
+		os.O_WRONLY|os.O_CREATE|os.O_EXCL, permRecordFile)
+	if err == nil {
+		return true, f.Close()
+	}
+	if !os.IsExist(err) {
+		return false, failed(fmt.Errorf("reserve container name failed: %v", err))
+	}
+	if err := s.checkOwner(containerName); err != nil {
+		return false, fmt.Errorf("container name %s is already in use", containerName)
+	}
+	return false, nil
+}
+
+// commitOwner records current user as the owner of the created container.
+func (s *Socker) commitOwner(containerName string) error {
+	return ioutil.WriteFile(path.Join(epilogDir, containerName),
+		[]byte(s.CurrentUID), permRecordFile)
+}
+
+// runDocker runs docker command as docker user and attaches it to the
+// streams of socker.
+func (s *Socker) runDocker(args ...string) error {
+	s.logger().Debugf("docker args: %v", args)
+	cmd, err := su.Command(s.dockerUID, cmdDocker, args...)
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = s.streams.Stdout
+	cmd.Stderr = s.streams.Stderr
+	return commandError(cmd.Run())
+}
+
+// renderArgs formats the parsed options back to command line arguments.
+func renderArgs(opts interface{}) []string {
+	var args []string
+	v := reflect.ValueOf(opts).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		long := v.Type().Field(i).Tag.Get("long")
+		if long == "" {
+			continue
+		}
+		flag := "--" + long
+		switch f := v.Field(i); f.Kind() {
+		case reflect.Bool:
+			if f.Bool() {
+				args = append(args, flag)
+			}
+		case reflect.String:
+			if f.String() != "" {
+				args = append(args, fmt.Sprintf("%s=%s", flag, f.String()))
+			}
+		case reflect.Slice:
+			for j := 0; j < f.Len(); j++ {
+				args = append(args, fmt.Sprintf("%s=%s", flag, f.Index(j).String()))
+			}
+		}
+	}
+	return args
+}
+
+// parseArgs parses the socker options before the first non-option argument,
+// the rest of arguments belong to the container and are returned untouched.
+func parseArgs(opts interface{}, args []string) ([]string, error) {
+	parser := flags.NewParser(opts, flags.PassDoubleDash|flags.PassAfterNonOption)
+	return parser.ParseArgs(args)
+}
+
 // RunImage runs container.
 func (s *Socker) RunImage(command []string) error {
+	rec := s.newAuditRecord("run", command)
+	return s.commandResult(rec, s.runImage(command, rec))
+}
+
+func (s *Socker) runImage(command []string, rec *AuditRecord) error {
 	opts := Opts{}
-	_, err := flags.ParseArgs(&opts, command)
+	remainedArgs, err := parseArgs(&opts, command)
 	if err != nil {
-		log.Errorf("parse command args failed: %v", err)
+		s.logger().Errorf("parse command args failed: %v", err)
 		return err
 	}
+	if len(remainedArgs) == 0 {
+		return fmt.Errorf("you must specifiy an image")
+	}
+	// the arguments after "--" are returned untouched by the parser, they
+	// would be taken as the options of docker run if they precede the image.
+	if strings.HasPrefix(remainedArgs[0], "-") {
+		return fmt.Errorf("invalid image %s, options must precede the image", remainedArgs[0])
+	}
 	// specified name has a higher priority, uniqueness is guaranteed by the
 	// user, it will automatically generate UUID as the name if it is empty.
-	if opts.Name != "" {
-		s.containerUUID = opts.Name
-	} else {
-		s.containerUUID = uuid.NewV4().String()
+	if opts.Name == "" {
+		opts.Name = uuid.NewV4().String()
+	}
+	// the name is used as file name of records, container names follow the
+	// same rule as volume names.
+	if !volumeNamePattern.MatchString(opts.Name) {
+		return fmt.Errorf("invalid container name %s", opts.Name)
+	}
+	s.containerUUID = opts.Name
+	rec.Container = opts.Name
+	if s.BestEffort && !s.rootStarted {
+		return fmt.Errorf("--best-effort is only allowed for root")
+	}
+	if err := s.isSecurityPermit(&opts); err != nil {
+		return err
+	}
+	if err := s.checkUser(&opts); err != nil {
+		return err
+	}
+	// the resources of container are limited to the allocation of job even
+	// if it can't be moved into the job cgroups.
+	if err := s.limitResources(&opts); err != nil {
+		return err
+	}
+	args := []string{"create",
+		"--label", fmt.Sprintf("%s=%s", labelOwner, s.CurrentUID)}
+	if s.isInsideJob {
+		args = append(args, "--label", fmt.Sprintf("%s=%s", labelJob, s.slurmJobID))
+	}
+	args = append(args, s.securityArgs(&opts)...)
+	rec.Image = remainedArgs[0]
+	opts.Volumes = append(s.defaultMounts(remainedArgs[0], &opts), opts.Volumes...)
+	// refuse to mount a directory that is not authorized to access, the
+	// volumes are mounted by the sources held open by the check.
+	defer s.releaseBinds()
+	if err := s.checkMounts(&opts); err != nil {
+		return err
 	}
-	args := []string{"run", "--name", s.containerUUID}
-	// refuse to mount a directory that is not authorized to access
-	if err := s.isVolumePermit(opts.Volumes); err != nil {
+	// the name is reserved before the files of container are prepared, so a
+	// run can't take over the container of others by its name.
+	reserved, err := s.reserveOwner(s.containerUUID)
+	if err != nil {
 		return err
 	}
+	created := false
+	defer func() {
+		if reserved && !created {
+			os.Remove(path.Join(epilogDir, s.containerUUID))
+		}
+	}()
+	// userns-remap is detected only for running containers, so the other
+	// commands can work without Docker daemon.
+	s.remap, s.remapErr = s.usernsRemap()
+	if s.remapErr != nil {
+		s.logger().Debugf("detect userns-remap failed: %v", s.remapErr)
+	}
 	// create security swap directory and mount into container.
 	if !s.Insecure {
-		swapDir := path.Join(s.homeDir, "container")
-		args = append(args, "-v", fmt.Sprintf("%s:%s", swapDir, swapDir))
-		err = os.MkdirAll(swapDir, 0777)
-		if err != nil {
-			return err
-		}
-		err = os.Chmod(swapDir, 0777)
-		if err != nil {
+		if err := s.checkUsernsRemap(); err != nil {
 			return err
 		}
-		err = os.Chmod(s.homeDir, 0755)
+		swapDir, err := s.prepareSwapDir(opts.User != "")
 		if err != nil {
-			return err
+			return failed(fmt.Errorf("prepare swap directory failed: %v", err))
 		}
+		args = append(args, "-v", fmt.Sprintf("%s:%s", swapDir, swapDir))
 	} else {
 		args = append(args, "-v", fmt.Sprintf("%s:%s", s.homeDir, s.homeDir))
 	}
+	// mount the node-local scratch directory of the job, it is removed by
+	// the epilog.
+	if s.isInsideJob && s.policy.JobScratch.Base != "" {
+		scratchDir, err := s.prepareJobScratch(opts.User != "")
+		if err != nil {
+			return failed(fmt.Errorf("prepare job scratch failed: %v", err))
+		}
+		args = append(args, "-v", fmt.Sprintf("%s:%s", scratchDir,
+			s.policy.JobScratch.Target))
+	}
+	// the user resolves by name in container if it runs as current user,
+	// the files are kept as long as the detached container is running.
+	passwdDir := ""
+	if opts.User != "" {
+		passwdDir, err = s.preparePasswd(remainedArgs[0])
+		if err != nil {
+			return failed(fmt.Errorf("prepare passwd files failed: %v", err))
+		}
+		if !opts.Detach {
+			defer os.RemoveAll(passwdDir)
+		}
+		args = append(args, s.passwdArgs(passwdDir)...)
+	}
+	// the container is created and started separately, -d belongs to start.
+	createOpts := opts
+	createOpts.Detach = false
+	args = append(args, renderArgs(&createOpts)...)
+	rec.Mounts = s.auditedMounts(mountsOf(args))
+	rec.Digest = s.imageDigest(remainedArgs[0])
+	if err := s.audit(rec, decisionAllow, nil); err != nil {
+		return fmt.Errorf("write audit log failed: %v", err)
+	}
 
-	go s.containerMonitor()
+	ctx, cancel := s.runContext()
+	defer cancel()
 
-	log.Debugf("epilog enabled: %t", s.EpilogEnabled)
+	args = append(args, remainedArgs...)
+	id, err := s.createContainer(args)
+	if err != nil {
+		return err
+	}
+	// the owner record is committed once the container is created, it is
+	// always kept to authorize the later operations on this container such
+	// as exec, logs and stop.
+	if err := s.commitOwner(s.containerUUID); err != nil {
+		s.removeContainer(id)
+		return err
+	}
+	created = true
+	s.logger().Debugf("epilog enabled: %t", s.EpilogEnabled)
 	if s.EpilogEnabled {
 		err := ioutil.WriteFile(path.Join(epilogDir, s.slurmJobID),
 			[]byte(s.containerUUID), permEpilogDir)
 		if err != nil {
 			return err
 		}
-		err = ioutil.WriteFile(path.Join(epilogDir, s.containerUUID),
-			[]byte(s.CurrentUID), permEpilogDir)
-		if err != nil {
+	}
+	// the monitor subscribes the events of the created container before it
+	// is started, so pulling the image doesn't count in the start timeout. It
+	// is stopped when the run returns.
+	var m *monitor
+	if s.isInsideJob {
+		m, err = s.startMonitor(ctx, id)
+		if err != nil && !s.isBestEffort() {
+			s.removeContainer(id)
 			return err
 		}
+		if err != nil {
+			s.logger().Warnf("container %s is not confined in job cgroups: %v", s.containerUUID, err)
+		}
 	}
-	args = append(args, command...)
-	log.Debugf("docker run args: %v", args)
-	cmd, err := su.Command(s.dockerUID, cmdDocker, args...)
-	if err != nil {
-		return err
-	}
-	if opts.TTY {
-		return s.runWithPty(cmd)
+	// the container is stopped when socker exits or dies unless detached, it
+	// is referred by the id so only the container created by this run is
+	// stopped.
+	if !opts.Detach {
+		release, err := s.acquireLease(id)
+		if err != nil {
+			return fmt.Errorf("acquire container lease failed: %v", err)
+		}
+		defer release()
+		stop := s.forwardSignals(id)
+		defer stop()
 	}
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return err
+	err = s.runMonitored(ctx, m, id, opts.Detach, func(ctx context.Context) error {
+		cmd, err := su.CommandContext(ctx, s.dockerUID, cmdDocker, startArgs(id, &opts)...)
+		if err != nil {
+			return err
+		}
+		if opts.TTY && !opts.Detach {
+			return s.runWithPty(cmd)
+		}
+		return s.runAttached(cmd, opts.Interactive && !opts.Detach)
+	})
+	if err != nil && opts.Detach {
+		os.RemoveAll(passwdDir)
 	}
-	fmt.Fprintf(os.Stdout, "%s", output)
-	return nil
+	return err
 }
 
-func isContainerRan(containerName string) (bool, error) {
-	cmd := exec.Command(cmdDocker, "events",
-		"--filter", "event=start",
-		"--filter", fmt.Sprintf("container=%s", containerName))
-	reader, err := cmd.StdoutPipe()
+// createContainer creates the container by the docker create args and returns
+// its id, the progress of pulling the image is written to the stderr.
+func (s *Socker) createContainer(args []string) (string, error) {
+	s.logger().Debugf("docker create args: %v", args)
+	cmd, err := su.Command(s.dockerUID, cmdDocker, args...)
 	if err != nil {
-		return false, err
+		return "", err
 	}
-	defer reader.Close()
-	err = cmd.Start()
+	cmd.Stderr = s.streams.Stderr
+	output, err := cmd.Output()
 	if err != nil {
-		return false, err
-	}
-	b := bufio.NewScanner(reader)
-	isStarted := make(chan bool, 1)
-	select {
-	case isStarted <- b.Scan():
-		log.Debugf("container started")
-		return true, nil
-	case <-time.After(containerRunTimeout):
-		log.Errorf("container start timeout")
-		return false, fmt.Errorf("container start timeout")
+		return "", commandError(err)
 	}
+	return strings.TrimSpace(string(output)), nil
 }
 
-func queryContainerPID(containerName string) (string, error) {
-	args := []string{"inspect", "-f", "{{ .State.Pid }}", containerName}
-	output, err := exec.Command(cmdDocker, args...).CombinedOutput()
-	if err != nil {
-		log.Errorf("query container pid failed: %v:%s", err, output)
-		return "", err
-	}
-	cmdPid := strings.TrimSpace(string(output))
-	output, err = exec.Command(cmdPs, "-o", "ppid=",
-		"-p", cmdPid).CombinedOutput()
-	log.Debugf("find cmdPid command: ps -o ppid= -p %s", cmdPid)
-	if err != nil {
-		log.Errorf("can't find docker-containe pid: %v,%s", err, output)
-		return "", err
+// startArgs returns the docker start args of the created container, it is
+// attached to the streams unless detached.
+func startArgs(id string, opts *Opts) []string {
+	args := []string{"start"}
+	if !opts.Detach {
+		args = append(args, "--attach")
+		if opts.Interactive {
+			args = append(args, "--interactive")
+		}
 	}
-	containerPID := strings.TrimSpace(string(output))
-	log.Debugf("container PID is: %s", containerPID)
-	return containerPID, nil
+	return append(args, id)
 }
 
-func (s *Socker) containerMonitor() error {
-	started, err := isContainerRan(s.containerUUID)
-	if err != nil {
-		log.Errorf("detect container status failed: %v", err)
-		return err
+// runContext returns the context of a run, it is cancelled when the remote
+// client hangs up, so the container is stopped as if socker was terminated.
+func (s *Socker) runContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if s.streams == nil || s.streams.Hangup == nil {
+		return ctx, cancel
 	}
-	if started && !s.Insecure {
-		// container has ran, change user's home dir permission.
-		defer changeDirPerm(s.homeDir)
+	go func() {
+		select {
+		case <-s.streams.Hangup:
+			s.logger().Infof("client hung up, stop container %s", s.containerUUID)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// runAttached runs the command with its stdout and stderr streamed to the
+// streams of socker, the stdin is attached only if interactive.
+func (s *Socker) runAttached(cmd *exec.Cmd, interactive bool) error {
+	cmd.Stdout = s.streams.Stdout
+	cmd.Stderr = s.streams.Stderr
+	if !interactive {
+		return cmd.Run()
 	}
-	if !s.isInsideJob {
-		log.Debugf("not inside of job")
-		return nil
+	if f, ok := s.streams.Stdin.(*os.File); ok {
+		cmd.Stdin = f
+		return cmd.Run()
 	}
-	err = s.enforceLimit()
+	// the stdin forwarded by the daemon may never reach EOF, it is copied
+	// without blocking Wait after the process exits.
+	stdin, err := cmd.StdinPipe()
 	if err != nil {
-		log.Errorf("enforce limit failed: %v", err)
+		return err
 	}
-	return nil
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go func() {
+		io.Copy(stdin, s.streams.Stdin)
+		stdin.Close()
+	}()
+	return cmd.Wait()
 }
 
-func changeDirPerm(dir string) error {
-	fileStat, err := os.Stat(dir)
+func (s *Socker) queryContainerPID(containerName string) (string, error) {
+	args := []string{"inspect", "-f", "{{ .State.Pid }}", containerName}
+	output, err := su.CombinedOutput(s.dockerUID, cmdDocker, args...)
 	if err != nil {
-		log.Errorf("get directory info failed: %v", err)
-		return err
+		s.logger().Errorf("query container pid failed: %v", err)
+		return "", err
 	}
-	if fileStat.Mode() == 0755 {
-		return nil
+	cmdPid := strings.TrimSpace(string(output))
+	cmd, err := trustedCommand(cmdPs, "-o", "ppid=", "-p", cmdPid)
+	if err != nil {
+		return "", err
 	}
-	err = os.Chmod(dir, 0750)
+	output, err = cmd.CombinedOutput()
+	s.logger().Debugf("find cmdPid command: ps -o ppid= -p %s", cmdPid)
 	if err != nil {
-		log.Errorf("change home dir permission error: %v", err)
+		s.logger().Errorf("can't find docker-containe pid: %v,%s", err, output)
+		return "", err
 	}
-	return nil
+	containerPID := strings.TrimSpace(string(output))
+	s.logger().Debugf("container PID is: %s", containerPID)
+	return containerPID, nil
 }
 
-func (s *Socker) enforceLimit() error {
-	containerPID, err := queryContainerPID(s.containerUUID)
+// enforceLimit moves the processes of container into the cgroups of job
+// until ctx is done, confined is called once all processes are moved.
+func (s *Socker) enforceLimit(ctx context.Context, confined func()) error {
+	containerPID, err := s.queryContainerPID(s.containerUUID)
 	if err != nil {
-		log.Errorf("query container pid error: %v", err)
+		s.logger().Errorf("query container pid error: %v", err)
 		return err
 	}
 	cgroupID := fmt.Sprintf("slurm/uid_%s/job_%s/", s.CurrentUID, s.slurmJobID)
-	log.Debugf("target cgroup id is: %s", cgroupID)
+	s.logger().Debugf("target cgroup id is: %s", cgroupID)
 	for {
 		pids, err := QueryChildPIDs(containerPID)
 		if err != nil {
-			log.Errorf("query child process ids failed: %v", err)
+			s.logger().Errorf("query child process ids failed: %v", err)
 		}
 		err = s.setCgroupLimit(pids, cgroupID)
 		if err != nil {
 			return err
 		}
+		confined()
 		// TODO: find a better way to watch cgroup new tasks without polling.
-		time.Sleep(time.Second * 1)
+		select {
+		case <-time.After(enforceInterval):
+		case <-ctx.Done():
+			return nil
+		}
 	}
 }
 
 func (s *Socker) setCgroupLimit(pids []string, cgroupID string) error {
 	for _, pid := range pids {
 		// frees process from the docker cgroups.
-		output, err := exec.Command(cmdCgclassify, "-g",
-			"cpu,cpuset,memory,devices:/", pid).CombinedOutput()
-		log.Debugf("frees container cgroups limit")
+		cmd, err := trustedCommand(cmdCgclassify, "-g",
+			"cpu,cpuset,memory,devices:/", pid)
 		if err != nil {
-			log.Errorf("frees container cgroups limit failed: %v:%s", err, output)
+			return err
+		}
+		output, err := cmd.CombinedOutput()
+		s.logger().Debugf("frees container cgroups limit")
+		if err != nil && !isProcessExisted(pid) {
+			continue
+		}
+		if err != nil {
+			s.logger().Errorf("frees container cgroups limit failed: %v:%s", err, output)
 			return err
 		}
 		// add process into slurm job cgroups.
-		output, err = exec.Command(cmdCgclassify, "-g",
+		cmd, err = trustedCommand(cmdCgclassify, "-g",
 			fmt.Sprintf("memory,cpu,cpuset,freezer,devices:/%s",
 				cgroupID),
-			pid).CombinedOutput()
-		log.Debugf("enforcing slurm limit to pid: %s", pid)
+			pid)
 		if err != nil {
-			log.Errorf("enforces Slurm job limit failed: %v:%s", err, output)
+			return err
+		}
+		output, err = cmd.CombinedOutput()
+		s.logger().Debugf("enforcing slurm limit to pid: %s", pid)
+		if err != nil && !isProcessExisted(pid) {
+			continue
+		}
+		if err != nil {
+			s.logger().Errorf("enforces Slurm job limit failed: %v:%s", err, output)
 			return err
 		}
 	}
 	return nil
 }
 
+// trustedCommand creates the command found in trustedCommandDirs, the
+// environment of user is not inherited.
+func trustedCommand(name string, args ...string) (*exec.Cmd, error) {
+	for _, d := range trustedCommandDirs {
+		p := path.Join(d, name)
+		if info, err := os.Stat(p); err == nil && !info.IsDir() {
+			cmd := exec.Command(p, args...)
+			cmd.Env = []string{}
+			return cmd, nil
+		}
+	}
+	return nil, fmt.Errorf("%s not found in %s", name, strings.Join(trustedCommandDirs, sepColon))
+}
+
+// isProcessExisted reports whether the process still exists, the processes
+// exit while they are being moved are skipped.
+func isProcessExisted(pid string) bool {
+	_, err := os.Stat(path.Join("/proc", pid))
+	return err == nil
+}
+
 // QueryChildPIDs lookups child process ids of specified parent process.
 func QueryChildPIDs(parentID string) ([]string, error) {
-	out, err := exec.Command(cmdPgrep, "-P", parentID).CombinedOutput()
+	cmd, err := trustedCommand(cmdPgrep, "-P", parentID)
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.CombinedOutput()
 	if err != nil {
 		// if no processes were matched pgrep exit with 1
 		if strings.Contains(err.Error(), "exit status 1") {
@@ -498,97 +1010,128 @@ func QueryChildPIDs(parentID string) ([]string, error) {
 	return pids, nil
 }
 
-func (s *Socker) isVolumePermit(vols []string) error {
-	for _, vol := range vols {
-		if !strings.HasSuffix(vol, ":ro") {
-			return fmt.Errorf("volume %s must mounted as read-only", vol)
-		}
-		if strings.Contains(vol, sepColon) {
-			vol = strings.Split(vol, sepColon)[0]
-		}
-		err := filepath.Walk(vol, walkfunc)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
-func walkfunc(vol string, info os.FileInfo, err error) error {
-	if err := unix.Access(vol, unix.R_OK); err != nil {
-		log.Debugf("volume %s permissin denined: %v", vol, err)
-		return fmt.Errorf("volume %s permissin denined: %v", vol, err)
-	}
-	return nil
-}
-
 func (s *Socker) runWithPty(cmd *exec.Cmd) error {
 	tty, err := pty.Start(cmd)
 	if err != nil {
 		return fmt.Errorf("docker command exec failed: %v", err)
 	}
-	// Handle pty size.
-	ch := make(chan os.Signal, 1)
-	signal.Notify(ch, syscall.SIGWINCH)
-	go func() {
-		for range ch {
-			if err := pty.InheritSize(os.Stdin, tty); err != nil {
-				log.Printf("error resizing pty: %s", err)
+	defer tty.Close()
+	if s.streams.Resize != nil {
+		// the terminal belongs to a remote client, follow its size changes.
+		go func() {
+			for ws := range s.streams.Resize {
+				if err := pty.Setsize(tty, ws); err != nil {
+					log.Printf("error resizing pty: %s", err)
+				}
 			}
-		}
-	}()
-	ch <- syscall.SIGWINCH // Initial resize.
+		}()
+	} else {
+		// Handle pty size.
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGWINCH)
+		go func() {
+			for range ch {
+				if err := pty.InheritSize(os.Stdin, tty); err != nil {
+					log.Printf("error resizing pty: %s", err)
+				}
+			}
+		}()
+		ch <- syscall.SIGWINCH // Initial resize.
 
-	oldState, err := terminal.MakeRaw(int(os.Stdin.Fd()))
-	if err != nil {
-		return err
+		oldState, err := terminal.MakeRaw(int(os.Stdin.Fd()))
+		if err != nil {
+			return err
+		}
+		defer func() { _ = terminal.Restore(int(os.Stdin.Fd()), oldState) }()
 	}
-	defer func() { _ = terminal.Restore(int(os.Stdin.Fd()), oldState) }()
-	go func() { io.Copy(os.Stdout, tty) }()
-	go func() { io.Copy(tty, os.Stdin) }()
-	return cmd.Wait()
+	copied := make(chan struct{})
+	go func() {
+		io.Copy(s.streams.Stdout, tty)
+		close(copied)
+	}()
+	go func() { io.Copy(tty, s.streams.Stdin) }()
+	err = cmd.Wait()
+	// drain the output left in pty before return.
+	<-copied
+	return err
 }
 
 func (s *Socker) checkPrerequisite() error {
 	if !isCommandAvailable(cmdDocker) {
 		return cli.NewExitError("docker command not found, make sure Docker is installed...", 127)
 	}
-	u, err := user.Lookup("dockerroot")
+	u, err := suser.LookupUser(dockerUser)
 	if err != nil {
 		return cli.NewExitError("there must exist a user 'dockerroot' and a group 'docker'", 1)
 	}
-	s.dockerUID = u.Uid
-	g, err := user.LookupGroup("docker")
+	s.dockerUID = strconv.Itoa(u.UID)
+	g, err := suser.LookupGroup("docker")
 	if err != nil {
 		return cli.NewExitError("there must exist a user 'dockerroot' and a group 'docker'", 1)
 	}
-	s.dockerGID = g.Gid
-	gids, err := u.GroupIds()
-	if err != nil && isMemberOfGroup(gids, u.Gid) {
+	s.dockerGID = strconv.Itoa(g.GID)
+	gids, err := u.GroupIDs()
+	if err != nil || !isMemberOfGroup(gids, g.GID) {
 		return cli.NewExitError("the user 'dockerroot' must be a member of the 'docker' group", 2)
 	}
-	current, err := user.Current()
+	current, err := suser.GetUserCredByUID(strconv.Itoa(os.Getuid()))
 	if err != nil {
 		return cli.NewExitError("can't get current user info", 2)
 	}
-	s.CurrentUID = current.Uid
-	s.currentUser = current.Username
-	s.currentGID = current.Gid
-	currentGroup, err := user.LookupGroupId(s.currentGID)
+	if err := current.Validate(); err != nil {
+		return cli.NewExitError(err.Error(), 2)
+	}
+	if err := s.setCaller(current.User, os.Environ()); err != nil {
+		return err
+	}
+	s.policy, err = loadPolicy(dftPolicyFile)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("load socker policy failed: %v", err), 2)
+	}
+	s.setupLogSinks()
+	return os.MkdirAll(epilogDir, permRecordFile)
+}
+
+// setCaller sets the user and the job information that socker acts on
+// behalf of. The job id of environment is defined by user, the caller is
+// taken as outside jobs unless it runs in the cgroups of the job.
+func (s *Socker) setCaller(u *suser.User, environ []string) error {
+	s.CurrentUID = strconv.Itoa(u.UID)
+	s.currentUser = u.Name
+	s.currentGID = strconv.Itoa(u.GID)
+	currentGroup, err := suser.LookupGroupID(u.GID)
 	if err != nil {
 		return cli.NewExitError("can't get current user's group info", 2)
 	}
 	s.currentGroup = currentGroup.Name
-	s.homeDir = current.HomeDir
-	if jobID := os.Getenv(envSlurmJobID); jobID != "" {
-		log.Debugf("slurm job id: %s", jobID)
-		s.isInsideJob = true
-		s.slurmJobID = jobID
+	s.homeDir = u.Home
+	s.environ = environ
+	s.isInsideJob = false
+	s.slurmJobID = ""
+	jobID := lookupEnv(environ, envSlurmJobID)
+	if jobID == "" {
+		return nil
 	}
-	return os.MkdirAll(epilogDir, permRecordFile)
+	if err := s.verifyJob(jobID); err != nil {
+		s.logger().Warnf("%s=%s is ignored: %v", envSlurmJobID, jobID, err)
+		return nil
+	}
+	s.logger().Debugf("slurm job id: %s", jobID)
+	s.isInsideJob = true
+	s.slurmJobID = jobID
+	return nil
+}
+
+func lookupEnv(environ []string, key string) string {
+	for _, env := range environ {
+		if strings.HasPrefix(env, key+"=") {
+			return strings.TrimPrefix(env, key+"=")
+		}
+	}
+	return ""
 }
 
-func isMemberOfGroup(gids []string, gid string) bool {
+func isMemberOfGroup(gids []int, gid int) bool {
 	for _, id := range gids {
 		if id == gid {
 			return true
@@ -1,12 +1,27 @@
 package socker
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
+	suser "github.com/China-HPC/go-socker/pkg/user"
+	log "github.com/Sirupsen/logrus"
 	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/sys/unix"
 )
 
 func TestQueryChildPIDs(t *testing.T) {
@@ -15,15 +30,34 @@ func TestQueryChildPIDs(t *testing.T) {
 		pids, err := QueryChildPIDs(pid)
 		So(err, ShouldBeNil)
 		So(pids, ShouldBeNil)
-		go func() {
-			exec.Command("bash", "-c", "sleep 1").Run()
-		}()
+		// the child is started before the query, a child started by a
+		// goroutine loses the race since pgrep is not looked up in PATH.
+		child := exec.Command("bash", "-c", "sleep 1")
+		So(child.Start(), ShouldBeNil)
+		defer child.Wait()
 		pids, err = QueryChildPIDs(pid)
 		So(err, ShouldBeNil)
 		So(len(pids), ShouldEqual, 1)
 	})
 }
 
+func TestTrustedCommand(t *testing.T) {
+	Convey("Test trustedCommand never looks up PATH", t, func() {
+		dir, err := ioutil.TempDir("", "bin")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		So(ioutil.WriteFile(path.Join(dir, cmdPgrep), []byte("#!/bin/sh\n"), 0755), ShouldBeNil)
+		defer os.Setenv("PATH", os.Getenv("PATH"))
+		os.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+		cmd, err := trustedCommand(cmdPgrep, "-P", "1")
+		So(err, ShouldBeNil)
+		So(path.Dir(cmd.Path), ShouldBeIn, trustedCommandDirs)
+		So(cmd.Env, ShouldBeEmpty)
+		_, err = trustedCommand("socker-test-no-such-command")
+		So(err, ShouldNotBeNil)
+	})
+}
+
 func TestListImagesData(t *testing.T) {
 	Convey("Test listImagesData", t, func() {
 		contents, err := listImagesData(".")
@@ -34,3 +68,1309 @@ func TestListImagesData(t *testing.T) {
 		So(content, ShouldNotBeNil)
 	})
 }
+
+func TestFrame(t *testing.T) {
+	Convey("Test frame read and write", t, func() {
+		var buf bytes.Buffer
+		var mu sync.Mutex
+		w := &frameWriter{mu: &mu, w: &buf, typ: frameStdout}
+		n, err := w.Write([]byte("hello"))
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 5)
+		So(writeFrame(&buf, frameExit, nil), ShouldBeNil)
+		typ, payload, err := readFrame(&buf)
+		So(err, ShouldBeNil)
+		So(typ, ShouldEqual, frameStdout)
+		So(string(payload), ShouldEqual, "hello")
+		typ, payload, err = readFrame(&buf)
+		So(err, ShouldBeNil)
+		So(typ, ShouldEqual, frameExit)
+		So(payload, ShouldBeEmpty)
+		_, _, err = readFrame(&buf)
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestAuthZPlugin(t *testing.T) {
+	Convey("Test authz plugin policy", t, func() {
+		config, err := ioutil.TempFile("", "images")
+		So(err, ShouldBeNil)
+		defer os.Remove(config.Name())
+		_, err = config.WriteString("ubuntu:latest:\n  id: sha256:1234abcd\n")
+		So(err, ShouldBeNil)
+		config.Close()
+		policy := defaultPolicy()
+		policy.Security.AllowedCapAdd = []string{"NET_RAW"}
+		policy.AuthZ.AllowUnauthenticated = true
+		s := &Socker{CurrentUID: "0", currentGID: "0", policy: policy}
+		p := NewAuthZPlugin(s, "", config.Name())
+		localID := "sha256:1234abcd5678"
+		p.imageID = func(name string) (string, error) { return localID, nil }
+		owners := map[string]string{"abc": "65534", "def": "1000"}
+		p.containerOwner = func(id string) (string, error) {
+			if owner, ok := owners[id]; ok {
+				return owner, nil
+			}
+			return "", fmt.Errorf("no such container: %s", id)
+		}
+		create := func(body string) *authZRequest {
+			return &authZRequest{
+				RequestMethod: "POST",
+				RequestURI:    "/v1.38/containers/create?name=test",
+				RequestBody:   []byte(body),
+			}
+		}
+		So(p.authorize(create(`{"Image":"ubuntu","User":"1000","Labels":{"org.china-hpc.socker.uid":"1000"}}`)), ShouldBeNil)
+		So(p.authorize(create(`{"Image":"1234ab","User":"1000","Labels":{"org.china-hpc.socker.uid":"1000"}}`)), ShouldBeNil)
+		So(p.authorize(create(`{"Image":"centos","User":"1000","Labels":{"org.china-hpc.socker.uid":"1000"}}`)), ShouldNotBeNil)
+		localID = "sha256:ffff"
+		So(p.authorize(create(`{"Image":"ubuntu","User":"1000","Labels":{"org.china-hpc.socker.uid":"1000"}}`)), ShouldNotBeNil)
+		localID = "sha256:1234abcd5678"
+		for _, uri := range []string{"/v1.38/images/create?fromImage=ubuntu",
+			"/v1.38/images/evil/tag?repo=ubuntu", "/images/load", "/v1.38/commit?container=x"} {
+			So(p.authorize(&authZRequest{RequestMethod: "POST", RequestURI: uri}), ShouldNotBeNil)
+			So(p.authorize(&authZRequest{User: "root", RequestMethod: "POST",
+				RequestURI: uri}), ShouldBeNil)
+		}
+		So(p.authorize(create(`{"Image":"ubuntu"}`)), ShouldNotBeNil)
+		So(p.authorize(create(`{"Image":"ubuntu","User":"root"}`)), ShouldNotBeNil)
+		So(p.authorize(create(`{"Image":"ubuntu","User":"0000"}`)), ShouldNotBeNil)
+		So(p.authorize(create(`{"Image":"ubuntu","User":"1000:0"}`)), ShouldNotBeNil)
+		So(p.authorize(create(`{"Image":"ubuntu","User":"1000:root"}`)), ShouldNotBeNil)
+		So(p.authorize(create(`{"Image":"ubuntu","User":"1000:1000","Labels":{"org.china-hpc.socker.uid":"1000"}}`)), ShouldBeNil)
+		So(p.authorize(create(`{"Image":"ubuntu","User":"1000","Labels":{"org.china-hpc.socker.uid":"1000"},
+			"HostConfig":{"Privileged":true}}`)), ShouldNotBeNil)
+		So(p.authorize(create(`{"Image":"ubuntu","User":"1000","Labels":{"org.china-hpc.socker.uid":"1000"},
+			"HostConfig":{"PidMode":"host"}}`)), ShouldNotBeNil)
+		for _, host := range []string{
+			`{"SecurityOpt":["seccomp=unconfined"]}`,
+			`{"SecurityOpt":["apparmor=unconfined"]}`,
+			`{"VolumesFrom":["other"]}`,
+			`{"NetworkMode":"container:other"}`,
+			`{"IpcMode":"container:other"}`,
+			`{"CgroupParent":"/"}`,
+			`{"Runtime":"custom"}`,
+		} {
+			So(p.authorize(create(`{"Image":"ubuntu","User":"1000","HostConfig":`+
+				host+`}`)), ShouldNotBeNil)
+		}
+		So(p.authorize(create(`{"Image":"ubuntu","User":"1000","Labels":{"org.china-hpc.socker.uid":"1000"},
+			"HostConfig":{"SecurityOpt":["no-new-privileges"],"NetworkMode":"host"}}`)), ShouldBeNil)
+		So(p.authorize(create(`{"Image":"ubuntu","User":"1000","Labels":{"org.china-hpc.socker.uid":"1000"},
+			"HostConfig":{"CapAdd":["cap_net_raw"]}}`)), ShouldBeNil)
+		So(p.authorize(create(`{"Image":"ubuntu","User":"1000","Labels":{"org.china-hpc.socker.uid":"1000"},
+			"HostConfig":{"CapAdd":["SYS_ADMIN"]}}`)), ShouldNotBeNil)
+		So(p.authorize(create(`{"Image":"ubuntu","User":"1000","Labels":{"org.china-hpc.socker.uid":"1000"},
+			"HostConfig":{"Binds":["/tmp:/tmp:ro"]}}`)), ShouldNotBeNil)
+		So(p.authorize(create(`{"Image":"ubuntu","User":"1000"}`)), ShouldNotBeNil)
+		So(p.authorize(create(`{"Image":"ubuntu","User":"1000",
+			"Labels":{"org.china-hpc.socker.uid":"1001"}}`)), ShouldNotBeNil)
+		for _, host := range []string{
+			`{"GroupAdd":["0"]}`,
+			`{"DeviceCgroupRules":["c *:* rwm"]}`,
+			`{"MaskedPaths":[]}`,
+			`{"ReadonlyPaths":[]}`,
+			`{"Sysctls":{"kernel.shm_rmid_forced":"1"}}`,
+		} {
+			So(p.authorize(create(`{"Image":"ubuntu","User":"1000",
+				"Labels":{"org.china-hpc.socker.uid":"1000"},"HostConfig":`+host+`}`)), ShouldNotBeNil)
+		}
+		exec := func(body string) *authZRequest {
+			return &authZRequest{
+				RequestMethod: "POST",
+				RequestURI:    "/v1.38/containers/abc/exec",
+				RequestBody:   []byte(body),
+			}
+		}
+		So(p.authorize(exec(`{"Privileged":true,"User":"1000"}`)), ShouldNotBeNil)
+		So(p.authorize(exec(`{"Cmd":["sh"]}`)), ShouldNotBeNil)
+		So(p.authorize(exec(`{"Cmd":["sh"],"User":"0"}`)), ShouldNotBeNil)
+		So(p.authorize(exec(`{"Cmd":["sh"],"User":"1000"}`)), ShouldBeNil)
+		So(p.authorize(&authZRequest{
+			RequestMethod: "POST",
+			RequestURI:    "/v1.38/containers/prune",
+		}), ShouldNotBeNil)
+		So(p.authorize(&authZRequest{
+			RequestMethod: "POST",
+			RequestURI:    "/v1.38/plugins/pull",
+		}), ShouldNotBeNil)
+		volumeCreate := func(body string) *authZRequest {
+			return &authZRequest{
+				RequestMethod: "POST",
+				RequestURI:    "/v1.38/volumes/create",
+				RequestBody:   []byte(body),
+			}
+		}
+		So(p.authorize(volumeCreate(`{"Name":"data","Labels":{"team":"a"}}`)), ShouldBeNil)
+		for _, body := range []string{
+			`{"Name":"data","DriverOpts":{"type":"none","o":"bind","device":"/etc"}}`,
+			`{"Name":"socker_1000_data"}`,
+			`{"Name":"data","Labels":{"org.china-hpc.socker.uid":"1000"}}`,
+		} {
+			So(p.authorize(volumeCreate(body)), ShouldNotBeNil)
+		}
+		So(p.authorize(&authZRequest{
+			RequestMethod: "GET",
+			RequestURI:    "/v1.38/containers/json",
+		}), ShouldBeNil)
+
+		policy.AuthZ.AllowUnauthenticated = false
+		So(p.authorize(create(`{"Image":"ubuntu","User":"1000","Labels":{"org.china-hpc.socker.uid":"1000"}}`)), ShouldNotBeNil)
+		if nobody, err := suser.LookupUserID(65534); err == nil {
+			req := create(`{"Image":"ubuntu","User":"65534","Labels":{"org.china-hpc.socker.uid":"65534"}}`)
+			req.User = nobody.Name
+			So(p.authorize(req), ShouldBeNil)
+			req = create(`{"Image":"ubuntu","User":"1000","Labels":{"org.china-hpc.socker.uid":"1000"}}`)
+			req.User = nobody.Name
+			So(p.authorize(req), ShouldNotBeNil)
+			req = create(`{"Image":"ubuntu","User":"65534","Labels":{"org.china-hpc.socker.uid":"65534"},
+				"HostConfig":{"Binds":["/tmp:/tmp:ro"]}}`)
+			req.User = nobody.Name
+			So(p.authorize(req), ShouldBeNil)
+			req = create(`{"Image":"ubuntu","User":"65534","Labels":{"org.china-hpc.socker.uid":"65534"},
+				"HostConfig":{"Binds":["/root:/root:ro"]}}`)
+			req.User = nobody.Name
+			So(p.authorize(req), ShouldNotBeNil)
+			req = create(`{"Image":"ubuntu","User":"65534","Labels":{"org.china-hpc.socker.uid":"65534"},
+				"HostConfig":{"Binds":["data:/data"]}}`)
+			req.User = nobody.Name
+			So(p.authorize(req), ShouldNotBeNil)
+			req = create(`{"Image":"ubuntu","User":"65534","Labels":{"org.china-hpc.socker.uid":"65534"},
+				"HostConfig":{"Mounts":[{"Type":"bind","Source":"/tmp","Target":"/tmp","ReadOnly":true}]}}`)
+			req.User = nobody.Name
+			So(p.authorize(req), ShouldBeNil)
+			for _, uri := range []string{"/v1.38/containers/abc/logs",
+				"/v1.38/containers/abc/archive?path=/", "/containers/abc/json"} {
+				So(p.authorize(&authZRequest{User: nobody.Name,
+					RequestMethod: "GET", RequestURI: uri}), ShouldBeNil)
+			}
+			for _, id := range []string{"def", "unknown"} {
+				req := &authZRequest{User: nobody.Name, RequestMethod: "GET",
+					RequestURI: "/v1.38/containers/" + id + "/logs"}
+				So(p.authorize(req), ShouldNotBeNil)
+				req.User = "root"
+				So(p.authorize(req), ShouldBeNil)
+			}
+			So(p.authorize(&authZRequest{User: nobody.Name, RequestMethod: "POST",
+				RequestURI: "/v1.38/containers/def/stop"}), ShouldNotBeNil)
+		}
+		req := &authZRequest{RequestMethod: "GET", RequestURI: "/v1.38/containers/def/json"}
+		So(p.authorize(req), ShouldNotBeNil)
+		req.RequestHeaders = map[string]string{"X-Socker-Authz": p.secret}
+		So(p.authorize(req), ShouldBeNil)
+		req.RequestHeaders = map[string]string{"X-Socker-Authz": "guess"}
+		So(p.authorize(req), ShouldNotBeNil)
+	})
+}
+
+func TestUsernsRemap(t *testing.T) {
+	Convey("Test usernsRemap", t, func() {
+		s := &Socker{dockerUID: "-1", userns: &usernsCache{}}
+		// the failure is not cached, it is detected again.
+		_, err := s.usernsRemap()
+		So(ExitCode(err), ShouldEqual, ExitCodeError)
+		So(s.userns.detected, ShouldBeFalse)
+		s.userns = &usernsCache{detected: true, remap: &remapRanges{
+			UIDs: &idRange{Start: 100000, Count: 65536},
+			GIDs: &idRange{Start: 200000, Count: 65536}}}
+		r, err := s.usernsRemap()
+		So(err, ShouldBeNil)
+		So(r.UIDs.Start, ShouldEqual, 100000)
+		uid, gid, err := r.hostIDs(1000, 1001)
+		So(err, ShouldBeNil)
+		So(uid, ShouldEqual, 101000)
+		So(gid, ShouldEqual, 201001)
+		_, _, err = r.hostIDs(70000, 1000)
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestRemapACL(t *testing.T) {
+	Convey("Test remapACL grants the remapped container user", t, func() {
+		s := &Socker{remap: &remapRanges{
+			UIDs: &idRange{Start: 100000, Count: 65536},
+			GIDs: &idRange{Start: 200000, Count: 65536}}}
+		entries, err := s.remapACL("--x", 1000, 1001, false, false)
+		So(err, ShouldBeNil)
+		So(entries, ShouldResemble, []string{"user:100000:--x"})
+		entries, err = s.remapACL("rwx", 1000, 1001, true, true)
+		So(err, ShouldBeNil)
+		So(entries, ShouldResemble, []string{"user:100000:rwx", "user:101000:rwx",
+			"group:201001:rwx", "default:user:100000:rwx", "default:user:101000:rwx",
+			"default:group:201001:rwx", "default:user:1000:rwx"})
+		_, err = s.remapACL("rwx", 70000, 1001, true, true)
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestLookupSubIDRange(t *testing.T) {
+	Convey("Test lookupSubIDRange", t, func() {
+		file, err := ioutil.TempFile("", "subuid")
+		So(err, ShouldBeNil)
+		defer os.Remove(file.Name())
+		_, err = file.WriteString("alice:100000:65536\ndockremap:165536:65536\n")
+		So(err, ShouldBeNil)
+		file.Close()
+		r, err := lookupSubIDRange(file.Name(), "dockremap")
+		So(err, ShouldBeNil)
+		So(r.Start, ShouldEqual, 165536)
+		So(r.Count, ShouldEqual, 65536)
+		_, err = lookupSubIDRange(file.Name(), "nobody-here")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestSecurityPolicy(t *testing.T) {
+	Convey("Test security baseline", t, func() {
+		policy := defaultPolicy()
+		policy.Security.CapAdd = []string{"CHOWN"}
+		policy.Security.AllowedCapAdd = []string{"NET_RAW"}
+		s := &Socker{policy: policy}
+		parse := func(args ...string) *Opts {
+			opts := &Opts{}
+			_, err := parseArgs(opts, args)
+			So(err, ShouldBeNil)
+			return opts
+		}
+		So(s.isSecurityPermit(parse("--cap-add", "NET_RAW", "ubuntu")), ShouldBeNil)
+		So(s.isSecurityPermit(parse("--pids-limit", "100", "ubuntu")), ShouldBeNil)
+		So(s.isSecurityPermit(parse("--privileged", "ubuntu")), ShouldNotBeNil)
+		So(s.isSecurityPermit(parse("--pid=host", "ubuntu")), ShouldNotBeNil)
+		So(s.isSecurityPermit(parse("--ipc", "container:other", "ubuntu")), ShouldNotBeNil)
+		So(s.isSecurityPermit(parse("--cap-add", "ALL", "ubuntu")), ShouldNotBeNil)
+		So(s.isSecurityPermit(parse("--security-opt", "seccomp=unconfined", "ubuntu")), ShouldNotBeNil)
+		So(s.isSecurityPermit(parse("--pids-limit=-1", "ubuntu")), ShouldNotBeNil)
+		So(s.isSecurityPermit(parse("--network", "container:other", "ubuntu")), ShouldNotBeNil)
+		So(s.isSecurityPermit(parse("--runtime", "custom", "ubuntu")), ShouldNotBeNil)
+		policy.Security.AllowedRuntimes = []string{"custom"}
+		So(s.isSecurityPermit(parse("--runtime", "custom", "ubuntu")), ShouldBeNil)
+		args := s.securityArgs(parse("ubuntu"))
+		So(args, ShouldResemble, []string{"--cap-drop", "ALL", "--cap-add", "CHOWN",
+			"--security-opt", "no-new-privileges", "--pids-limit", "4096"})
+	})
+}
+
+func TestRunImageArgs(t *testing.T) {
+	Convey("Test runImage refuses the options after the image", t, func() {
+		s := &Socker{}
+		for _, command := range [][]string{
+			{"--", "--privileged", "-v", "/:/host", "busybox", "sh"},
+			{"--", "-v", "/:/host", "busybox"},
+			{},
+		} {
+			err := s.runImage(command, &AuditRecord{})
+			So(err, ShouldNotBeNil)
+		}
+	})
+}
+
+func TestCheckNamedVolume(t *testing.T) {
+	Convey("Test checkNamedVolume", t, func() {
+		s := &Socker{CurrentUID: "1000", currentUser: "alice"}
+		So(s.checkNamedVolume("v", "local|null|1000\n"), ShouldBeNil)
+		So(s.checkNamedVolume("v", "local|{}|1000\n"), ShouldBeNil)
+		So(s.checkNamedVolume("v", "local|null|1001\n"), ShouldNotBeNil)
+		So(s.checkNamedVolume("v",
+			`local|{"device":"/etc","o":"bind","type":"none"}|1000`), ShouldNotBeNil)
+		So(s.checkNamedVolume("v", "nfs|null|1000\n"), ShouldNotBeNil)
+		So(s.checkNamedVolume("v", ""), ShouldNotBeNil)
+	})
+}
+
+func TestReserveOwner(t *testing.T) {
+	Convey("Test reserveOwner", t, func() {
+		dir, err := ioutil.TempDir("", "epilog")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		defer func(d string) { epilogDir = d }(epilogDir)
+		epilogDir = dir
+		alice := &Socker{CurrentUID: "1000"}
+		bob := &Socker{CurrentUID: "1001"}
+		reserved, err := alice.reserveOwner("job")
+		So(err, ShouldBeNil)
+		So(reserved, ShouldBeTrue)
+		// the reserved container is not accessible until it is committed.
+		So(alice.checkOwner("job"), ShouldNotBeNil)
+		_, err = bob.reserveOwner("job")
+		So(err, ShouldNotBeNil)
+		So(alice.commitOwner("job"), ShouldBeNil)
+		So(alice.checkOwner("job"), ShouldBeNil)
+		_, err = bob.reserveOwner("job")
+		So(err, ShouldNotBeNil)
+		So(bob.checkOwner("job"), ShouldNotBeNil)
+		reserved, err = alice.reserveOwner("job")
+		So(err, ShouldBeNil)
+		So(reserved, ShouldBeFalse)
+	})
+}
+
+// fakeDocker replaces docker by the shell script in dir, the arguments of
+// every docker command are appended to the returned log file.
+func fakeDocker(dir, script string) string {
+	log := path.Join(dir, "docker.log")
+	cmd := path.Join(dir, "docker")
+	script = fmt.Sprintf("#!/bin/sh\necho \"$@\" >> %s\n%s\n", log, script)
+	So(ioutil.WriteFile(cmd, []byte(script), 0755), ShouldBeNil)
+	cmdDocker = cmd
+	return log
+}
+
+func TestRunImageNameInUse(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("running docker as the docker user requires root")
+	}
+	Convey("Test runImage never stops a container it didn't create", t, func() {
+		dir, err := ioutil.TempDir("", "run")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		defer func(cmd, d string) { cmdDocker, epilogDir = cmd, d }(cmdDocker, epilogDir)
+		epilogDir = dir
+		dockerLog := fakeDocker(dir, `case "$1" in
+create) echo "Conflict. The container name is already in use" >&2; exit 125;;
+esac`)
+		policy := defaultPolicy()
+		policy.DefaultMounts = nil
+		policy.AuditFile = ""
+		s := &Socker{dockerUID: "0", CurrentUID: "1000", currentGID: "1000",
+			homeDir: dir, policy: policy, Config: &Config{Insecure: true},
+			streams: &Streams{Stdout: ioutil.Discard, Stderr: ioutil.Discard}}
+		err = s.runImage([]string{"--name", "victim", "busybox", "true"}, &AuditRecord{})
+		So(ExitCode(err), ShouldEqual, ExitCodeError)
+		data, err := ioutil.ReadFile(dockerLog)
+		So(err, ShouldBeNil)
+		So(string(data), ShouldContainSubstring, "create")
+		So(string(data), ShouldNotContainSubstring, "start")
+		So(string(data), ShouldNotContainSubstring, "stop")
+		// the reserved name is released.
+		_, err = os.Stat(path.Join(dir, "victim"))
+		So(os.IsNotExist(err), ShouldBeTrue)
+	})
+}
+
+func TestRunImage(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("running docker as the docker user requires root")
+	}
+	Convey("Test runImage attached without --user", t, func() {
+		dir, err := ioutil.TempDir("", "run")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		defer func(cmd, e, r, exe string) {
+			cmdDocker, epilogDir, runDir, selfExe = cmd, e, r, exe
+		}(cmdDocker, epilogDir, runDir, selfExe)
+		epilogDir = path.Join(dir, "epilog")
+		So(os.Mkdir(epilogDir, 0700), ShouldBeNil)
+		runDir = path.Join(dir, "run")
+		selfExe = "/bin/true"
+		dockerLog := fakeDocker(dir, `echo "DOCKER_HOST=$DOCKER_HOST" >> `+path.Join(dir, "docker.log")+`
+case "$1" in
+create) echo 0123456789abcdef;;
+esac`)
+		// the environment of user never points docker to another daemon.
+		defer os.Unsetenv("DOCKER_HOST")
+		os.Setenv("DOCKER_HOST", "tcp://127.0.0.1:2375")
+		policy := defaultPolicy()
+		policy.DefaultMounts = nil
+		policy.AuditFile = ""
+		s := &Socker{dockerUID: "0", CurrentUID: "1000", currentGID: "1000",
+			homeDir: dir, policy: policy, Config: &Config{Insecure: true},
+			streams: &Streams{Stdout: ioutil.Discard, Stderr: ioutil.Discard}}
+		err = s.runImage([]string{"--name", "job", "busybox", "true"}, &AuditRecord{})
+		So(err, ShouldBeNil)
+		data, err := ioutil.ReadFile(dockerLog)
+		So(err, ShouldBeNil)
+		So(string(data), ShouldContainSubstring, "start --attach 0123456789abcdef")
+		So(string(data), ShouldContainSubstring, "stop --time 10 0123456789abcdef")
+		So(string(data), ShouldNotContainSubstring, "tcp://")
+		info, err := os.Stat(path.Join(runDir, "job"))
+		So(err, ShouldBeNil)
+		So(info.Mode().Perm(), ShouldEqual, os.FileMode(0700))
+		So(s.checkOwner("job"), ShouldBeNil)
+	})
+}
+
+func TestRunImageMonitor(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("running docker as the docker user requires root")
+	}
+	Convey("Test runImage monitors the container once it is created", t, func() {
+		dir, err := ioutil.TempDir("", "run")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		defer func(cmd, e, r string) {
+			cmdDocker, epilogDir, runDir = cmd, e, r
+		}(cmdDocker, epilogDir, runDir)
+		epilogDir = path.Join(dir, "epilog")
+		So(os.Mkdir(epilogDir, 0700), ShouldBeNil)
+		runDir = path.Join(dir, "run")
+		dockerLog := fakeDocker(dir, `case "$1" in
+create) echo 0123456789abcdef;;
+esac`)
+		policy := defaultPolicy()
+		policy.DefaultMounts = nil
+		policy.AuditFile = ""
+		policy.Confinement = confinementBestEffort
+		policy.Limits.CPUs = 1
+		s := &Socker{dockerUID: "0", CurrentUID: "1000", currentGID: "1000",
+			homeDir: dir, policy: policy, Config: &Config{Insecure: true},
+			isInsideJob: true, slurmJobID: "42",
+			streams: &Streams{Stdout: ioutil.Discard, Stderr: ioutil.Discard}}
+		err = s.runImage([]string{"-d", "--name", "job", "busybox", "true"}, &AuditRecord{})
+		So(err, ShouldBeNil)
+		data, err := ioutil.ReadFile(dockerLog)
+		So(err, ShouldBeNil)
+		created := strings.Index(string(data), "create ")
+		subscribed := strings.Index(string(data), "container=0123456789abcdef")
+		So(created, ShouldBeGreaterThanOrEqualTo, 0)
+		So(subscribed, ShouldBeGreaterThan, created)
+	})
+}
+
+func TestCheckMounts(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("changing file owner requires root")
+	}
+	Convey("Test checkMounts", t, func() {
+		base, err := ioutil.TempDir("", "volume")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(base)
+		So(os.Chmod(base, 0755), ShouldBeNil)
+		scratch := path.Join(base, "scratch")
+		for _, dir := range []string{"scratch/user", "scratch/other", "private"} {
+			So(os.MkdirAll(path.Join(base, dir), 0755), ShouldBeNil)
+		}
+		So(os.Chown(path.Join(scratch, "user"), 12345, 12345), ShouldBeNil)
+		So(os.Chmod(path.Join(base, "private"), 0700), ShouldBeNil)
+		So(os.Symlink(path.Join(scratch, "user"), path.Join(base, "link")), ShouldBeNil)
+		policy := defaultPolicy()
+		policy.WritableMountPrefixes = []string{scratch}
+		s := &Socker{CurrentUID: "12345", currentGID: "12345", policy: policy}
+
+		check := func(vol string) ([]string, error) {
+			opts := &Opts{Volumes: []string{vol}}
+			defer s.releaseBinds()
+			if err := s.checkMounts(opts); err != nil {
+				return nil, err
+			}
+			return s.auditedMounts(opts.Mounts), nil
+		}
+		mounts, err := check(path.Join(scratch, "other") + ":/data:ro")
+		So(err, ShouldBeNil)
+		So(mounts, ShouldResemble, []string{"type=bind,source=" +
+			path.Join(scratch, "other") + ",target=/data,readonly"})
+		_, err = check(path.Join(scratch, "other") + ":/data")
+		So(err, ShouldNotBeNil)
+		_, err = check(path.Join(base, "private") + ":/data:ro")
+		So(err, ShouldNotBeNil)
+		_, err = check(base + ":/data")
+		So(err, ShouldNotBeNil)
+
+		opts := &Opts{Volumes: []string{path.Join(base, "link") + ":/data"}}
+		So(s.checkMounts(opts), ShouldBeNil)
+		So(opts.Mounts, ShouldHaveLength, 1)
+		So(opts.Mounts[0], ShouldStartWith, fmt.Sprintf("type=bind,source=/proc/%d/fd/", os.Getpid()))
+		So(s.auditedMounts(opts.Mounts), ShouldResemble,
+			[]string{"type=bind,source=" + path.Join(scratch, "user") + ",target=/data"})
+		// the checked directory is mounted even if the path is replaced.
+		checked, err := os.Stat(path.Join(scratch, "user"))
+		So(err, ShouldBeNil)
+		So(os.Rename(path.Join(scratch, "user"), path.Join(scratch, "moved")), ShouldBeNil)
+		So(os.Symlink(path.Join(base, "private"), path.Join(scratch, "user")), ShouldBeNil)
+		source := strings.TrimPrefix(strings.Split(opts.Mounts[0], ",")[1], "source=")
+		held, err := os.Stat(source)
+		So(err, ShouldBeNil)
+		So(os.SameFile(checked, held), ShouldBeTrue)
+		s.releaseBinds()
+		_, err = os.Stat(source)
+		So(err, ShouldNotBeNil)
+	})
+}
+
+// setACL sets the access ACL of the file as setfacl does.
+func setACL(p string, acl []aclEntry) error {
+	data := make([]byte, xattrACLHeader+len(acl)*xattrACLEntry)
+	binary.LittleEndian.PutUint32(data, xattrACLVersion)
+	for i, e := range acl {
+		off := xattrACLHeader + i*xattrACLEntry
+		binary.LittleEndian.PutUint16(data[off:], e.Tag)
+		binary.LittleEndian.PutUint16(data[off+2:], uint16(e.Perm))
+		binary.LittleEndian.PutUint32(data[off+4:], e.ID)
+	}
+	return unix.Setxattr(p, xattrACLAccess, data, 0)
+}
+
+func TestCheckMountsACL(t *testing.T) {
+	Convey("Test the permissions of mounts granted by ACLs", t, func() {
+		cred := &credential{uid: 12345, gids: map[uint32]bool{12345: true}}
+		dir := uint32(unix.S_IFDIR)
+		// user:12345:rwx, group::r-x, group:23456:rwx, mask::r-x
+		acl := []aclEntry{{Tag: aclUserObj, Perm: 7}, {Tag: aclUser, Perm: 7, ID: 12345},
+			{Tag: aclGroupObj, Perm: 5}, {Tag: aclGroup, Perm: 7, ID: 23456},
+			{Tag: aclMask, Perm: 5}, {Tag: aclOther, Perm: 0}}
+		So(cred.readable(0, 0, dir|0750, acl), ShouldBeTrue)
+		So(cred.permits(0, 0, dir|0750, acl, permWrite), ShouldBeFalse)
+		So(cred.readable(0, 0, dir|0750, nil), ShouldBeFalse)
+		acl[4].Perm = 7
+		So(cred.permits(0, 0, dir|0770, acl, permWrite), ShouldBeTrue)
+		// the named group entry is masked, the other bits are not used.
+		cred = &credential{uid: 34567, gids: map[uint32]bool{23456: true}}
+		acl[4].Perm = 4
+		So(cred.readable(0, 0, dir|0745, acl), ShouldBeFalse)
+		So(cred.permits(0, 0, dir|0745, acl, permRead), ShouldBeTrue)
+		cred = &credential{uid: 34567, gids: map[uint32]bool{34567: true}}
+		So(cred.readable(0, 0, dir|0745, acl), ShouldBeTrue)
+
+		_, err := parseACLXattr([]byte{2, 0, 0, 0, 1})
+		So(err, ShouldNotBeNil)
+		_, err = parseACLXattr([]byte{1, 0, 0, 0})
+		So(err, ShouldNotBeNil)
+
+		if os.Getuid() != 0 {
+			return
+		}
+		base, err := ioutil.TempDir("", "acl")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(base)
+		So(os.Chmod(base, 0755), ShouldBeNil)
+		shared := path.Join(base, "shared")
+		So(os.Mkdir(shared, 0750), ShouldBeNil)
+		So(os.Chown(shared, 23456, 23456), ShouldBeNil)
+		policy := defaultPolicy()
+		policy.WritableMountPrefixes = []string{base}
+		s := &Socker{CurrentUID: "12345", currentGID: "12345", policy: policy}
+		check := func(vol string) error {
+			defer s.releaseBinds()
+			return s.checkMounts(&Opts{Volumes: []string{vol}})
+		}
+		So(check(shared+":/data:ro"), ShouldNotBeNil)
+		err = setACL(shared, []aclEntry{{Tag: aclUserObj, Perm: 7},
+			{Tag: aclUser, Perm: 7, ID: 12345}, {Tag: aclGroupObj, Perm: 5},
+			{Tag: aclMask, Perm: 5}, {Tag: aclOther, Perm: 0}})
+		if err == unix.EOPNOTSUPP {
+			return
+		}
+		So(err, ShouldBeNil)
+		So(check(shared+":/data:ro"), ShouldBeNil)
+		So(check(shared+":/data"), ShouldNotBeNil)
+		So(setACL(shared, []aclEntry{{Tag: aclUserObj, Perm: 7},
+			{Tag: aclUser, Perm: 7, ID: 12345}, {Tag: aclGroupObj, Perm: 5},
+			{Tag: aclMask, Perm: 7}, {Tag: aclOther, Perm: 0}}), ShouldBeNil)
+		So(check(shared+":/data"), ShouldBeNil)
+		// the directories on the path must be searchable.
+		So(os.MkdirAll(path.Join(shared, "sub"), 0777), ShouldBeNil)
+		So(setACL(shared, []aclEntry{{Tag: aclUserObj, Perm: 7},
+			{Tag: aclUser, Perm: 4, ID: 12345}, {Tag: aclGroupObj, Perm: 5},
+			{Tag: aclMask, Perm: 7}, {Tag: aclOther, Perm: 0}}), ShouldBeNil)
+		So(check(path.Join(shared, "sub")+":/data:ro"), ShouldNotBeNil)
+	})
+}
+
+func TestParseMounts(t *testing.T) {
+	Convey("Test parsing volumes, mounts and tmpfs", t, func() {
+		v, err := parseVolume("data:/data:ro")
+		So(err, ShouldBeNil)
+		So(v.Type, ShouldEqual, mountVolume)
+		So(v.ReadOnly, ShouldBeTrue)
+		v, err = parseMount("type=bind,src=/scratch,dst=/scratch,readonly")
+		So(err, ShouldBeNil)
+		So(v.mountSpec(), ShouldEqual, "type=bind,source=/scratch,target=/scratch,readonly")
+		_, err = parseMount("type=volume,src=data,dst=/data,volume-driver=local")
+		So(err, ShouldNotBeNil)
+		_, err = parseMount("type=npipe,src=data,dst=/data")
+		So(err, ShouldNotBeNil)
+		_, err = parseVolume("../data:/data")
+		So(err, ShouldNotBeNil)
+		v, err = parseTmpfs("/run:size=64m,mode=1777")
+		So(err, ShouldBeNil)
+		So(v.mountSpec(), ShouldEqual, "type=tmpfs,target=/run,tmpfs-size=67108864,tmpfs-mode=1777")
+
+		s := &Socker{policy: defaultPolicy()}
+		v, err = parseTmpfs("/tmp")
+		So(err, ShouldBeNil)
+		So(s.checkTmpfs(v), ShouldBeNil)
+		So(v.TmpfsSize, ShouldEqual, 1<<30)
+		v, err = parseMount("type=tmpfs,dst=/tmp,tmpfs-size=2g")
+		So(err, ShouldBeNil)
+		So(s.checkTmpfs(v), ShouldNotBeNil)
+	})
+}
+
+func TestVolumeDeepCheck(t *testing.T) {
+	Convey("Test bounded deep check of volumes", t, func() {
+		base, err := ioutil.TempDir("", "deep")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(base)
+		So(os.Chmod(base, 0755), ShouldBeNil)
+		So(os.MkdirAll(path.Join(base, "a/b"), 0755), ShouldBeNil)
+		So(ioutil.WriteFile(path.Join(base, "a/b/secret"), nil, 0600), ShouldBeNil)
+		s := &Socker{CurrentUID: "12345", currentGID: "12345", policy: defaultPolicy()}
+		check := func() error {
+			defer s.releaseBinds()
+			return s.checkMounts(&Opts{Volumes: []string{base + ":/data:ro"}})
+		}
+		So(check(), ShouldBeNil)
+		s.policy.VolumeDeepCheck.MaxEntries = 100
+		So(check(), ShouldNotBeNil)
+		s.policy.VolumeDeepCheck.MaxDepth = 2
+		So(check(), ShouldBeNil)
+		s.policy.VolumeDeepCheck = VolumeDeepCheck{MaxEntries: 2}
+		So(check(), ShouldBeNil)
+	})
+}
+
+// BenchmarkCheckMounts measures the mount validation on a large tree, it is
+// independent of the number of files unless deep check is enabled.
+func BenchmarkCheckMounts(b *testing.B) {
+	base, err := ioutil.TempDir("", "bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+	os.Chmod(base, 0755)
+	for i := 0; i < 100; i++ {
+		dir := path.Join(base, fmt.Sprintf("dir%d", i))
+		if err := os.Mkdir(dir, 0755); err != nil {
+			b.Fatal(err)
+		}
+		for j := 0; j < 500; j++ {
+			if err := ioutil.WriteFile(path.Join(dir, fmt.Sprintf("f%d", j)), nil, 0644); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	s := &Socker{CurrentUID: "12345", currentGID: "12345", policy: defaultPolicy()}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := s.checkMounts(&Opts{Volumes: []string{base + ":/data:ro"}}); err != nil {
+			b.Fatal(err)
+		}
+		s.releaseBinds()
+	}
+}
+
+func TestMergePasswd(t *testing.T) {
+	Convey("Test merge passwd and group files", t, func() {
+		u := &suser.User{UID: 1000, GID: 100, Name: "alice",
+			Home: "/home/alice", Shell: "/bin/sh"}
+		image := "root:x:0:0:root:/root:/bin/bash\nubuntu:x:1000:1000::/home/ubuntu:/bin/bash\n"
+		So(string(mergePasswd([]byte(image), u)), ShouldEqual,
+			"root:x:0:0:root:/root:/bin/bash\nalice:x:1000:100:alice:/home/alice:/bin/sh\n")
+		So(string(mergePasswd(nil, u)), ShouldEqual,
+			"root:x:0:0:root:/root:/bin/sh\nalice:x:1000:100:alice:/home/alice:/bin/sh\n")
+		groups := []*suser.Group{
+			{GID: 100, Name: "users", Users: []string{"alice"}},
+			{GID: 2000, Name: "hpc", Users: []string{"alice"}},
+		}
+		image = "root:x:0:\nusers:x:100:\nhpc:x:3000:\n"
+		So(string(mergeGroup([]byte(image), groups)), ShouldEqual,
+			"root:x:0:\nusers:x:100:alice\nhpc:x:2000:alice\n")
+
+		s := &Socker{CurrentUID: "1000", currentUser: "alice", currentGID: "100",
+			currentGroup: "users"}
+		opts := &Opts{}
+		So(s.checkUser(opts), ShouldBeNil)
+		So(opts.User, ShouldBeEmpty)
+		for _, user := range []string{"alice", "1000", "alice:users", "1000:100"} {
+			opts.User = user
+			So(s.checkUser(opts), ShouldBeNil)
+			So(opts.User, ShouldEqual, "1000:100")
+		}
+		for _, user := range []string{"root", "0", "0:0", "bob", "alice:root", "1000:0", "01000"} {
+			opts.User = user
+			So(s.checkUser(opts), ShouldNotBeNil)
+		}
+	})
+}
+
+func TestAuthorize(t *testing.T) {
+	Convey("Test command authorization by group", t, func() {
+		u, err := suser.LookupUserID(65534)
+		if err != nil {
+			SkipSo(err, ShouldBeNil)
+			return
+		}
+		g, err := suser.LookupGroupID(u.GID)
+		So(err, ShouldBeNil)
+		dir, err := ioutil.TempDir("", "audit")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		policy := defaultPolicy()
+		policy.AuditFile = path.Join(dir, "audit.log")
+		s := &Socker{CurrentUID: "65534", currentUser: u.Name, policy: policy}
+		So(s.Authorize("run"), ShouldBeNil)
+		policy.Access.Groups = []string{"root"}
+		policy.Access.Message = "contact hpc@example.com"
+		err = s.Authorize("run")
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "contact hpc@example.com")
+		policy.Access.Commands = map[string][]string{"run": {"root", g.Name}}
+		So(s.Authorize("run"), ShouldBeNil)
+		So(s.Authorize("ps"), ShouldNotBeNil)
+		So(s.IsDelegated("run"), ShouldBeTrue)
+		So(s.IsDelegated("images sync"), ShouldBeFalse)
+		root := &Socker{CurrentUID: "0", policy: policy}
+		So(root.Authorize("ps"), ShouldBeNil)
+
+		err = s.SyncImages("/etc/sudoers.d/socker", "", "")
+		So(ExitCode(err), ShouldEqual, ExitCodeDenied)
+	})
+}
+
+func TestAudit(t *testing.T) {
+	Convey("Test audit log", t, func() {
+		So(sanitizeArgv([]string{"-e", "TOKEN=secret", "--env=KEY=v", "-eA=b",
+			"-v", "/data:/data", "ubuntu", "--", "env", "-e", "X=1"}), ShouldResemble,
+			[]string{"-e", "TOKEN=***", "--env=KEY=***", "-eA=***",
+				"-v", "/data:/data", "ubuntu", "--", "env", "-e", "X=1"})
+		So(mountsOf([]string{"run", "-v", "/a:/a", "--mount=type=tmpfs,dst=/b",
+			"--tmpfs", "/c", "ubuntu"}), ShouldResemble,
+			[]string{"/a:/a", "type=tmpfs,dst=/b", "/c"})
+		if os.Getuid() != 0 {
+			SkipSo(os.Getuid(), ShouldEqual, 0)
+			return
+		}
+		dir, err := ioutil.TempDir("", "audit")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		policy := defaultPolicy()
+		policy.AuditFile = path.Join(dir, "log", "audit.log")
+		s := &Socker{CurrentUID: "1000", currentUser: "alice", policy: policy,
+			slurmJobID: "42", environ: []string{"SLURM_STEP_ID=0"}}
+		rec := s.newAuditRecord("run", []string{"-e", "A=b", "ubuntu"})
+		rec.Image = "ubuntu"
+		So(s.audit(rec, decisionAllow, nil), ShouldBeNil)
+		s.auditDenial(s.newAuditRecord("exec", nil), fmt.Errorf("not owner"))
+		data, err := ioutil.ReadFile(policy.AuditFile)
+		So(err, ShouldBeNil)
+		lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+		So(lines, ShouldHaveLength, 2)
+		got := &AuditRecord{}
+		So(json.Unmarshal(lines[0], got), ShouldBeNil)
+		So(got.User, ShouldEqual, "alice")
+		So(got.JobID, ShouldEqual, "42")
+		So(got.StepID, ShouldEqual, "0")
+		So(got.Argv, ShouldResemble, []string{"-e", "A=***", "ubuntu"})
+		So(got.Decision, ShouldEqual, decisionAllow)
+		So(json.Unmarshal(lines[1], got), ShouldBeNil)
+		So(got.Decision, ShouldEqual, decisionDeny)
+		So(got.Reason, ShouldEqual, "not owner")
+		So(got.PrevHash, ShouldEqual, hashAuditRecord(lines[0]))
+		So(os.Chmod(policy.AuditFile, 0666), ShouldBeNil)
+		So(s.audit(rec, decisionAllow, nil), ShouldNotBeNil)
+	})
+}
+
+func TestAuditChain(t *testing.T) {
+	Convey("Test hash chain of audit log", t, func() {
+		if os.Getuid() != 0 {
+			SkipSo(os.Getuid(), ShouldEqual, 0)
+			return
+		}
+		dir, err := ioutil.TempDir("", "audit")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		policy := defaultPolicy()
+		policy.AuditFile = path.Join(dir, "audit.log")
+		policy.AuditMaxSize = "1k"
+		out := &bytes.Buffer{}
+		s := &Socker{CurrentUID: "1000", currentUser: "alice", policy: policy,
+			streams: &Streams{Stdout: out}}
+		for i := 0; i < 20; i++ {
+			rec := s.newAuditRecord("run", []string{"ubuntu", fmt.Sprint(i)})
+			So(s.audit(rec, decisionAllow, nil), ShouldBeNil)
+		}
+		files, err := auditFiles(policy.AuditFile)
+		So(err, ShouldBeNil)
+		So(len(files), ShouldBeGreaterThan, 2)
+		So(s.VerifyAudit(nil), ShouldBeNil)
+		So(out.String(), ShouldContainSubstring, "20 records verified, 0 problems")
+
+		data, err := ioutil.ReadFile(files[1])
+		So(err, ShouldBeNil)
+		data = bytes.Replace(data, []byte(`"alice"`), []byte(`"bob"`), 1)
+		So(ioutil.WriteFile(files[1], data, 0600), ShouldBeNil)
+		out.Reset()
+		So(s.VerifyAudit(nil), ShouldNotBeNil)
+		So(out.String(), ShouldContainSubstring, "1 problems found")
+
+		out.Reset()
+		So(s.VerifyAudit(files[2:]), ShouldBeNil)
+		So(out.String(), ShouldContainSubstring, "chain starts after")
+	})
+}
+
+func TestLogger(t *testing.T) {
+	Convey("Test the logs of daemon carry the fields of callers", t, func() {
+		daemon := &Socker{CurrentUID: "0", currentUser: "root"}
+		hook := &contextHook{s: daemon}
+		entry := log.WithField("image-name", "ubuntu")
+		So(hook.Fire(entry), ShouldBeNil)
+		So(entry.Data[fieldUser], ShouldEqual, "root")
+
+		NewDaemon(daemon, "")
+		caller := *daemon
+		caller.CurrentUID, caller.currentUser, caller.slurmJobID = "1000", "alice", "42"
+		entry = caller.logger()
+		So(hook.Fire(entry), ShouldBeNil)
+		So(entry.Data[fieldUser], ShouldEqual, "alice")
+		So(entry.Data[fieldJob], ShouldEqual, "42")
+		entry = log.WithField("image-name", "ubuntu")
+		So(hook.Fire(entry), ShouldBeNil)
+		So(entry.Data, ShouldNotContainKey, fieldUser)
+	})
+}
+
+func TestJournaldHook(t *testing.T) {
+	Convey("Test journald log sink", t, func() {
+		dir, err := ioutil.TempDir("", "journal")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		addr := &net.UnixAddr{Name: path.Join(dir, "socket"), Net: "unixgram"}
+		server, err := net.ListenUnixgram("unixgram", addr)
+		So(err, ShouldBeNil)
+		defer server.Close()
+		conn, err := net.Dial("unixgram", addr.Name)
+		So(err, ShouldBeNil)
+		defer conn.Close()
+
+		s := &Socker{CurrentUID: "1000", currentUser: "alice", slurmJobID: "42"}
+		entry := log.WithFields(log.Fields{"image-name": "ubuntu"})
+		entry.Level = log.ErrorLevel
+		entry.Message = "run failed\nexit 1"
+		So((&contextHook{s: s}).Fire(entry), ShouldBeNil)
+		So((&journaldHook{conn: conn}).Fire(entry), ShouldBeNil)
+		buf := make([]byte, maxJournalMessage)
+		n, err := server.Read(buf)
+		So(err, ShouldBeNil)
+		msg := string(buf[:n])
+		So(msg, ShouldContainSubstring, "MESSAGE\n\x11\x00\x00\x00\x00\x00\x00\x00run failed\nexit 1\n")
+		So(msg, ShouldContainSubstring, "PRIORITY=3\n")
+		So(msg, ShouldContainSubstring, "SOCKER_USER=alice\n")
+		So(msg, ShouldContainSubstring, "SOCKER_JOB=42\n")
+		So(msg, ShouldContainSubstring, "SOCKER_IMAGE_NAME=ubuntu\n")
+		So(msg, ShouldNotContainSubstring, "SOCKER_CONTAINER")
+	})
+}
+
+func TestExitCode(t *testing.T) {
+	Convey("Test exit code of commands", t, func() {
+		So(ExitCode(nil), ShouldEqual, 0)
+		So(ExitCode(fmt.Errorf("failed")), ShouldEqual, 1)
+		So(ExitCode(commandError(exec.Command("sh", "-c", "exit 3").Run())), ShouldEqual, 3)
+		So(ExitCode(commandError(exec.Command("sh", "-c", "kill -TERM $$").Run())),
+			ShouldEqual, 128+int(syscall.SIGTERM))
+		So(ExitCode(commandError(exec.Command("socker-no-such-command").Run())),
+			ShouldEqual, ExitCodeError)
+		err := denied(fmt.Errorf("volume is not permitted"))
+		So(ExitCode(err), ShouldEqual, ExitCodeDenied)
+		So(err.Error(), ShouldEqual, "volume is not permitted")
+		So(commandError(err), ShouldEqual, err)
+		So(commandError(nil), ShouldBeNil)
+		So(ExitCode(failed(fmt.Errorf("docker volume create failed"))), ShouldEqual, ExitCodeError)
+		So(ExitCode(failed(err)), ShouldEqual, ExitCodeDenied)
+
+		// only the refusals are audited as denials.
+		dir, err := ioutil.TempDir("", "audit")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		policy := defaultPolicy()
+		policy.AuditFile = path.Join(dir, "audit.log")
+		s := &Socker{CurrentUID: "1000", policy: policy}
+		err = s.commandResult(s.newAuditRecord("run", nil),
+			failed(fmt.Errorf("prepare swap directory failed")))
+		So(ExitCode(err), ShouldEqual, ExitCodeError)
+		_, statErr := os.Stat(policy.AuditFile)
+		So(os.IsNotExist(statErr), ShouldBeTrue)
+		err = s.commandResult(s.newAuditRecord("run", nil), fmt.Errorf("volume is not permitted"))
+		So(ExitCode(err), ShouldEqual, ExitCodeDenied)
+		data, err := ioutil.ReadFile(policy.AuditFile)
+		So(err, ShouldBeNil)
+		So(string(data), ShouldContainSubstring, `"decision":"deny"`)
+	})
+}
+
+func TestClientHangup(t *testing.T) {
+	Convey("Test the run is cancelled when the client hangs up", t, func() {
+		server, client := net.Pipe()
+		defer server.Close()
+		stdinReader, stdinWriter := io.Pipe()
+		defer stdinReader.Close()
+		hangup := make(chan struct{})
+		done := make(chan struct{})
+		defer close(done)
+		go demuxClient(server, stdinWriter, nil, make(chan os.Signal, 1), hangup, done)
+		s := &Socker{streams: &Streams{Hangup: hangup}}
+		ctx, cancel := s.runContext()
+		defer cancel()
+		ran := make(chan error, 1)
+		go func() {
+			ran <- s.runMonitored(ctx, nil, "socker-test-no-such-container", false,
+				func(ctx context.Context) error {
+					<-ctx.Done()
+					return ctx.Err()
+				})
+		}()
+		client.Close()
+		select {
+		case err := <-ran:
+			So(err, ShouldEqual, context.Canceled)
+		case <-time.After(5 * time.Second):
+			So("the run is not cancelled", ShouldBeEmpty)
+		}
+	})
+}
+
+func TestRunAttached(t *testing.T) {
+	Convey("Test streamed stdio of non-TTY runs", t, func() {
+		stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+		s := &Socker{streams: &Streams{
+			Stdin:  bytes.NewBufferString("data\n"),
+			Stdout: stdout,
+			Stderr: stderr,
+		}}
+		cmd := exec.Command("sh", "-c", "cat; echo err >&2")
+		So(s.runAttached(cmd, true), ShouldBeNil)
+		So(stdout.String(), ShouldEqual, "data\n")
+		So(stderr.String(), ShouldEqual, "err\n")
+
+		stdout.Reset()
+		So(s.runAttached(exec.Command("cat"), false), ShouldBeNil)
+		So(stdout.String(), ShouldBeEmpty)
+
+		// the stdin never reaches EOF.
+		r, w := io.Pipe()
+		defer w.Close()
+		s.streams.Stdin = r
+		done := make(chan error, 1)
+		go func() { done <- s.runAttached(exec.Command("sh", "-c", "exit 3"), true) }()
+		select {
+		case err := <-done:
+			So(ExitCode(commandError(err)), ShouldEqual, 3)
+		case <-time.After(5 * time.Second):
+			So("runAttached is blocked by stdin", ShouldBeEmpty)
+		}
+	})
+}
+
+func TestSignals(t *testing.T) {
+	Convey("Test signal forwarding", t, func() {
+		sig, err := parseSignal("usr1")
+		So(err, ShouldBeNil)
+		So(sig, ShouldEqual, syscall.SIGUSR1)
+		sig, err = parseSignal("SIGCONT")
+		So(err, ShouldBeNil)
+		So(sig, ShouldEqual, syscall.SIGCONT)
+		_, err = parseSignal("SIGKILL")
+		So(err, ShouldNotBeNil)
+		So(isStopSignal(syscall.SIGTERM), ShouldBeTrue)
+		So(isStopSignal(syscall.SIGUSR1), ShouldBeFalse)
+
+		signals := make(chan os.Signal, 1)
+		s := &Socker{dockerUID: "0", policy: defaultPolicy(),
+			streams: &Streams{Signals: signals}}
+		s.policy.Signals.StopTimeout = 0
+		stop := s.forwardSignals("socker-test-no-such-container")
+		signals <- syscall.SIGUSR1
+		stopped := make(chan struct{})
+		go func() {
+			stop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(10 * time.Second):
+			So("stop is blocked", ShouldBeEmpty)
+		}
+	})
+}
+
+func TestRunMonitored(t *testing.T) {
+	Convey("Test runMonitored", t, func() {
+		s := &Socker{dockerUID: "0", policy: defaultPolicy()}
+		s.policy.Signals.StopTimeout = 0
+		exited := &ExitError{Code: 3}
+		err := s.runMonitored(context.Background(), nil, "socker-test-no-such-container", false,
+			func(context.Context) error { return exited })
+		So(err, ShouldEqual, exited)
+
+		m := &monitor{confined: make(chan struct{}), err: make(chan error, 1)}
+		m.markConfined()
+		m.markConfined()
+		err = s.runMonitored(context.Background(), m, "socker-test-no-such-container", true,
+			func(context.Context) error { return nil })
+		So(err, ShouldBeNil)
+
+		m = &monitor{confined: make(chan struct{}), err: make(chan error, 1)}
+		m.err <- fmt.Errorf("cgclassify failed")
+		err = s.runMonitored(context.Background(), m, "socker-test-no-such-container", false,
+			func(context.Context) error {
+				time.Sleep(100 * time.Millisecond)
+				return nil
+			})
+		So(ExitCode(err), ShouldEqual, ExitCodeError)
+
+		// the docker command is killed if the container does not start.
+		m = &monitor{confined: make(chan struct{}), err: make(chan error, 1)}
+		m.err <- fmt.Errorf("container did not start")
+		killed := false
+		err = s.runMonitored(context.Background(), m, "socker-test-no-such-container", false,
+			func(ctx context.Context) error {
+				<-ctx.Done()
+				killed = true
+				return ctx.Err()
+			})
+		So(ExitCode(err), ShouldEqual, ExitCodeError)
+		So(killed, ShouldBeTrue)
+
+		s.policy.Confinement = confinementBestEffort
+		m = &monitor{confined: make(chan struct{}), err: make(chan error, 1)}
+		m.err <- fmt.Errorf("cgclassify failed")
+		err = s.runMonitored(context.Background(), m, "socker-test-no-such-container", true,
+			func(context.Context) error { return nil })
+		So(err, ShouldBeNil)
+
+		s.policy.Confinement = confinementStrict
+		s.Config = &Config{BestEffort: true}
+		So(s.isBestEffort(), ShouldBeFalse)
+		// the daemon started by root runs on behalf of other users.
+		s.rootStarted = true
+		s.CurrentUID = "1000"
+		So(s.isBestEffort(), ShouldBeTrue)
+	})
+}
+
+func TestLease(t *testing.T) {
+	Convey("Test container lease", t, func() {
+		So(IsSupervisor(), ShouldBeFalse)
+		l := &lease{Container: "test", PID: os.Getpid()}
+		So(l.expired(), ShouldBeFalse)
+		cmd := exec.Command("true")
+		So(cmd.Run(), ShouldBeNil)
+		l.PID = cmd.Process.Pid
+		So(l.expired(), ShouldBeTrue)
+		So(Supervise([]string{"test"}), ShouldEqual, 2)
+		So(Supervise([]string{"../test", "10"}), ShouldEqual, 2)
+
+		// the supervisor started by others has no token of the lease.
+		token := strings.Repeat("0f", leaseTokenSize)
+		So(l.verify(strings.NewReader(token)), ShouldNotBeNil)
+		l.Token = token
+		So(l.verify(strings.NewReader(token+"r")), ShouldBeNil)
+		So(l.verify(strings.NewReader(strings.Repeat("0e", leaseTokenSize))), ShouldNotBeNil)
+		So(l.verify(strings.NewReader(token[:10])), ShouldNotBeNil)
+
+		So(jobCgroupRoots("12:freezer:/slurm/uid_1000/job_42/step_0\n"+
+			"4:memory:/slurm/uid_1000/job_42/step_0/task_0\n"+
+			"1:name=systemd:/system.slice/sshd.service\n"), ShouldResemble,
+			[]string{path.Join(cgroupRoot, "freezer"), path.Join(cgroupRoot, "memory")})
+		So(jobCgroupRoots("0::/system.slice/slurmstepd.scope/job_42/step_0/user/task_0\n"),
+			ShouldResemble, []string{cgroupRoot})
+		So(jobCgroupRoots("0::/user.slice/user-1000.slice/session-1.scope\n"), ShouldBeEmpty)
+	})
+}
+
+func TestGC(t *testing.T) {
+	Convey("Test gc of orphaned state", t, func() {
+		root, err := ioutil.TempDir("", "cgroup")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(root)
+		saved := cgroupRoot
+		defer func() { cgroupRoot = saved }()
+		cgroupRoot = root
+		_, known := jobCgroupExists("42")
+		So(known, ShouldBeFalse)
+		So(os.MkdirAll(path.Join(root, "memory/slurm/uid_1000/job_42"), 0755), ShouldBeNil)
+		exists, known := jobCgroupExists("42")
+		So(exists, ShouldBeTrue)
+		So(known, ShouldBeTrue)
+		exists, known = jobCgroupExists("43")
+		So(exists, ShouldBeFalse)
+		So(known, ShouldBeTrue)
+		_, known = jobCgroupExists("../42")
+		So(known, ShouldBeFalse)
+
+		now := time.Now()
+		c := &collector{now: now, containers: map[string]bool{"alive": true},
+			removed: map[string]bool{"removed": true}}
+		So(c.isStale("alive", now.Add(-2*gcGracePeriod)), ShouldBeFalse)
+		So(c.isStale("removed", now), ShouldBeTrue)
+		So(c.isStale("gone", now), ShouldBeFalse)
+		So(c.isStale("gone", now.Add(-2*gcGracePeriod)), ShouldBeTrue)
+	})
+}
+
+func TestLimitResources(t *testing.T) {
+	Convey("Test limiting resources to the job allocation", t, func() {
+		root, err := ioutil.TempDir("", "cgroup")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(root)
+		saved := cgroupRoot
+		defer func() { cgroupRoot = saved }()
+		cgroupRoot = root
+		s := &Socker{CurrentUID: "1000", slurmJobID: "42", policy: defaultPolicy(),
+			environ: []string{"SLURM_CPUS_ON_NODE=2", "SLURM_MEM_PER_NODE=1024"}}
+		opts := &Opts{}
+		So(s.limitResources(opts), ShouldBeNil)
+		So(opts, ShouldResemble, &Opts{})
+
+		// the Slurm environment is defined by user and never trusted.
+		s.isInsideJob = true
+		So(s.limitResources(opts), ShouldNotBeNil)
+		s.policy.Limits = ResourceLimits{CPUs: 2, Memory: "1g"}
+		So(s.limitResources(opts), ShouldBeNil)
+		So(opts.CPUs, ShouldEqual, "2")
+		So(opts.Memory, ShouldEqual, "1073741824")
+		So(opts.MemorySwap, ShouldEqual, "1073741824")
+		So(opts.CpusetCPUs, ShouldBeEmpty)
+		// the limits of policy hold outside jobs.
+		s.isInsideJob = false
+		So(s.limitResources(&Opts{CPUs: "4"}), ShouldNotBeNil)
+		s.isInsideJob = true
+		s.policy.Limits = ResourceLimits{Memory: "lots"}
+		So(ExitCode(s.limitResources(&Opts{})), ShouldEqual, ExitCodeError)
+
+		cpuset := path.Join(root, "cpuset/slurm/uid_1000/job_42")
+		memory := path.Join(root, "memory/slurm/uid_1000/job_42")
+		So(os.MkdirAll(cpuset, 0755), ShouldBeNil)
+		So(os.MkdirAll(memory, 0755), ShouldBeNil)
+		So(ioutil.WriteFile(path.Join(cpuset, "cpuset.cpus"), []byte("0-3,8\n"), 0644), ShouldBeNil)
+		So(ioutil.WriteFile(path.Join(cpuset, "cpuset.mems"), []byte("0\n"), 0644), ShouldBeNil)
+		So(ioutil.WriteFile(path.Join(memory, "memory.limit_in_bytes"), []byte("2147483648\n"), 0644), ShouldBeNil)
+		opts = &Opts{}
+		So(s.limitResources(opts), ShouldBeNil)
+		So(opts.CPUs, ShouldEqual, "5")
+		So(opts.CpusetCPUs, ShouldEqual, "0-3,8")
+		So(opts.CpusetMems, ShouldEqual, "0")
+		So(opts.Memory, ShouldEqual, "2147483648")
+
+		opts = &Opts{CPUs: "1.5", CpusetCPUs: "2,8", Memory: "1g"}
+		So(s.limitResources(opts), ShouldBeNil)
+		So(opts.CpusetCPUs, ShouldEqual, "2,8")
+		So(opts.Memory, ShouldEqual, "1073741824")
+		So(s.limitResources(&Opts{CPUs: "6"}), ShouldNotBeNil)
+		So(s.limitResources(&Opts{CpusetCPUs: "4-5"}), ShouldNotBeNil)
+		So(s.limitResources(&Opts{Memory: "4g"}), ShouldNotBeNil)
+		So(s.limitResources(&Opts{MemorySwap: "-1"}), ShouldNotBeNil)
+		_, err = parseCPUList("0-999999999")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestDefaultMounts(t *testing.T) {
+	Convey("Test site default mounts", t, func() {
+		base, err := ioutil.TempDir("", "defaults")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(base)
+		So(os.Mkdir(path.Join(base, "alice"), 0755), ShouldBeNil)
+		policy := defaultPolicy()
+		policy.DefaultMounts = []string{
+			base + "/${USER}:/scratch/${USER}",
+			base + "/${SLURM_JOB_ACCOUNT}:/project",
+			base + "/missing:/missing:ro",
+		}
+		s := &Socker{currentUser: "alice", policy: policy}
+		So(s.defaultMounts("ubuntu", &Opts{}), ShouldResemble,
+			[]string{base + "/alice:/scratch/alice"})
+		s.environ = []string{"SLURM_JOB_ACCOUNT=alice"}
+		So(s.defaultMounts("ubuntu", &Opts{}), ShouldResemble,
+			[]string{base + "/alice:/scratch/alice", base + "/alice:/project"})
+		s.environ = []string{"SLURM_JOB_ACCOUNT=../etc"}
+		So(s.defaultMounts("ubuntu", &Opts{}), ShouldHaveLength, 1)
+		opts := &Opts{Volumes: []string{"/tmp:/scratch/alice"}}
+		So(s.defaultMounts("ubuntu", opts), ShouldBeEmpty)
+	})
+}
+
+func TestPrepareJobScratch(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("changing file owner requires root")
+	}
+	Convey("Test prepareJobScratch", t, func() {
+		base, err := ioutil.TempDir("", "scratch")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(base)
+		So(os.Chmod(base, 0755), ShouldBeNil)
+		policy := defaultPolicy()
+		policy.JobScratch.Base = base
+		s := &Socker{CurrentUID: "12345", currentGID: "12345",
+			slurmJobID: "42", policy: policy}
+		dir, err := s.prepareJobScratch(false)
+		So(err, ShouldBeNil)
+		So(dir, ShouldEqual, path.Join(base, "42"))
+		info, err := os.Stat(dir)
+		So(err, ShouldBeNil)
+		So(info.Sys().(*syscall.Stat_t).Uid, ShouldEqual, 12345)
+		_, err = s.prepareJobScratch(false)
+		So(err, ShouldBeNil)
+		s.slurmJobID = "../42"
+		_, err = s.prepareJobScratch(false)
+		So(err, ShouldNotBeNil)
+		So(os.Chown(dir, 23456, 23456), ShouldBeNil)
+		s.slurmJobID = "42"
+		_, err = s.prepareJobScratch(false)
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestSetCaller(t *testing.T) {
+	Convey("Test setCaller verifies the job of caller", t, func() {
+		dir, err := ioutil.TempDir("", "proc")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		defer func(root string) { procRoot = root }(procRoot)
+		procRoot = dir
+		// the caller is the client of daemon.
+		s := &Socker{clientPID: 4242}
+		So(os.Mkdir(path.Join(dir, "4242"), 0755), ShouldBeNil)
+		cgroupFile := path.Join(dir, "4242", "cgroup")
+		u := &suser.User{Name: "root", Home: "/root"}
+		for _, c := range []struct {
+			cgroup string
+			jobID  string
+			inside bool
+		}{
+			{"0::/user.slice\n", "42", false},
+			{"4:memory:/slurm/uid_0/job_43/step_0\n", "42", false},
+			{"4:memory:/slurm/uid_0/job_42/step_0\n", "42", true},
+			{"0::/system.slice/slurmstepd.scope/job_42/step_0/user/task_0\n", "42", true},
+			{"4:memory:/slurm/uid_0/job_42/step_0\n", "*", false},
+			{"4:memory:/slurm/uid_0/job_42/step_0\n", "42/../../..", false},
+			{"4:memory:/slurm/uid_0/job_42/step_0\n", "", false},
+		} {
+			So(ioutil.WriteFile(cgroupFile, []byte(c.cgroup), 0644), ShouldBeNil)
+			So(s.setCaller(u, []string{envSlurmJobID + "=" + c.jobID}), ShouldBeNil)
+			So(s.isInsideJob, ShouldEqual, c.inside)
+			if c.inside {
+				So(s.slurmJobID, ShouldEqual, c.jobID)
+			} else {
+				So(s.slurmJobID, ShouldBeEmpty)
+			}
+		}
+	})
+}
+
+func TestCgroupJobID(t *testing.T) {
+	Convey("Test cgroupJobID", t, func() {
+		So(cgroupJobID("12:pids:/user.slice\n4:memory:/slurm/uid_1000/job_42/step_0\n"),
+			ShouldEqual, "42")
+		So(cgroupJobID("0::/system.slice/slurmstepd.scope/job_7/step_batch/user/task_0\n"),
+			ShouldEqual, "7")
+		So(cgroupJobID("0::/user.slice/job_x\n4:memory:/slurm/uid_1000/job_42x\n"),
+			ShouldBeEmpty)
+		So(cgroupJobID(""), ShouldBeEmpty)
+	})
+}
+
+func TestParseACL(t *testing.T) {
+	Convey("Test parseACL", t, func() {
+		acl := parseACL("user::rwx\nuser:100000:rwx\t#effective:---\n" +
+			"group::---\nmask::---\nother::---\ndefault:user:1000:rwx\n")
+		So(acl["user:100000"], ShouldEqual, "---")
+		So(acl["default:user:1000"], ShouldEqual, "rwx")
+		So(acl["mask:"], ShouldEqual, "---")
+		So(hasExtendedACL(acl), ShouldBeTrue)
+		acl = parseACL("# file: /proc/self/fd/3\nuser::rwx\ngroup::---\nother::---\n")
+		So(acl["user:"], ShouldEqual, "rwx")
+		So(hasExtendedACL(acl), ShouldBeFalse)
+	})
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2018 China-HPC.
+
+package socker
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// frame types of the socker daemon protocol, every message exchanged over
+// the socket is a frame which consists of a type byte, a big endian uint32
+// payload length and the payload.
+const (
+	frameRequest byte = iota
+	frameStdin
+	frameStdinClose
+	frameResize
+	frameStdout
+	frameStderr
+	frameExit
+	frameSignal
+
+	frameHeaderSize = 5
+	maxFrameSize    = 1 << 20
+)
+
+// Request represents a command request sent from socker client to daemon.
+type Request struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+	TTY     bool     `json:"tty"`
+}
+
+// exitStatus represents the result of a command served by socker daemon.
+type exitStatus struct {
+	Code  int    `json:"code"`
+	Error string `json:"error,omitempty"`
+}
+
+func writeFrame(w io.Writer, typ byte, payload []byte) error {
+	header := make([]byte, frameHeaderSize)
+	header[0] = typ
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+func readFrame(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxFrameSize {
+		return 0, nil, fmt.Errorf("frame size %d exceeds the limit", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+// frameWriter writes data as frames of the specified type, the frames of
+// different writers sharing the same connection are serialized by mu.
+type frameWriter struct {
+	mu  *sync.Mutex
+	w   io.Writer
+	typ byte
+}
+
+func (fw *frameWriter) Write(p []byte) (int, error) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	for start := 0; start < len(p); start += maxFrameSize {
+		end := start + maxFrameSize
+		if end > len(p) {
+			end = len(p)
+		}
+		if err := writeFrame(fw.w, fw.typ, p[start:end]); err != nil {
+			return start, err
+		}
+	}
+	return len(p), nil
+}
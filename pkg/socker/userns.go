@@ -0,0 +1,187 @@
+// Copyright (c) 2018 China-HPC.
+
+package socker
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/China-HPC/go-socker/pkg/su"
+	suser "github.com/China-HPC/go-socker/pkg/user"
+)
+
+const (
+	subUIDFile         = "/etc/subuid"
+	subGIDFile         = "/etc/subgid"
+	dockerDaemonConfig = "/etc/docker/daemon.json"
+	keyUsernsRemap     = "userns-remap"
+	dftRemapUser       = "dockremap"
+	secOptUserns       = "name=userns"
+)
+
+// idRange represents a range of subordinate ids.
+type idRange struct {
+	Start int
+	Count int
+}
+
+// remapRanges are the host uid and gid ranges which the ids of containers are
+// mapped to by userns-remap.
+type remapRanges struct {
+	UIDs *idRange
+	GIDs *idRange
+}
+
+// hostIDs returns the host uid and gid which the uid and gid of container are
+// mapped to.
+func (r *remapRanges) hostIDs(uid, gid int) (int, int, error) {
+	if uid < 0 || uid >= r.UIDs.Count || gid < 0 || gid >= r.GIDs.Count {
+		return 0, 0, fmt.Errorf("%d:%d is not mapped by userns-remap", uid, gid)
+	}
+	return r.UIDs.Start + uid, r.GIDs.Start + gid, nil
+}
+
+// usernsCache caches the detection of userns-remap, it is shared by the
+// callers of daemon so docker info is not queried for every command.
+type usernsCache struct {
+	mu       sync.Mutex
+	detected bool
+	remap    *remapRanges
+	err      error
+}
+
+// usernsRemap returns the detection of userns-remap, it is detected on the
+// first call. The failures, e.g. Docker daemon is not running, are not cached.
+func (s *Socker) usernsRemap() (*remapRanges, error) {
+	c := s.userns
+	if c == nil {
+		return s.detectUsernsRemap()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.detected {
+		c.remap, c.err = s.detectUsernsRemap()
+		c.detected = ExitCode(c.err) != ExitCodeError
+	}
+	return c.remap, c.err
+}
+
+// detectUsernsRemap detects whether Docker daemon runs with userns-remap, and
+// returns the host id ranges which the container ids are mapped to.
+func (s *Socker) detectUsernsRemap() (*remapRanges, error) {
+	cmd, err := su.Command(s.dockerUID, cmdDocker, "info", "--format",
+		"{{json .SecurityOptions}}")
+	if err != nil {
+		return nil, failed(fmt.Errorf("query docker info failed: %v", err))
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, failed(fmt.Errorf("query docker info failed: %v", err))
+	}
+	var secOpts []string
+	if err := json.Unmarshal(out, &secOpts); err != nil {
+		return nil, failed(fmt.Errorf("parse docker security options failed: %v", err))
+	}
+	enabled := false
+	for _, secOpt := range secOpts {
+		// the security options are formatted as "name=userns" since Docker
+		// 1.13, and as "userns" before.
+		for _, field := range strings.Split(secOpt, ",") {
+			if field == secOptUserns || field == "userns" {
+				enabled = true
+			}
+		}
+	}
+	if !enabled {
+		return nil, fmt.Errorf("Docker daemon has no userns-remap enabled")
+	}
+	remapUser, err := usernsRemapUser(dockerDaemonConfig)
+	if err != nil {
+		return nil, failed(err)
+	}
+	uids, err := lookupSubIDRange(subUIDFile, remapUser)
+	if err != nil {
+		return nil, failed(err)
+	}
+	gids, err := lookupSubIDRange(subGIDFile, remapUser)
+	if err != nil {
+		return nil, failed(err)
+	}
+	s.logger().Debugf("userns-remap user %s, host uid range: %d-%d, gid range: %d-%d",
+		remapUser, uids.Start, uids.Start+uids.Count-1, gids.Start, gids.Start+gids.Count-1)
+	return &remapRanges{UIDs: uids, GIDs: gids}, nil
+}
+
+// usernsRemapUser returns the userns-remap user configured in Docker daemon
+// config, Docker creates and uses dockremap if it is "default".
+func usernsRemapUser(config string) (string, error) {
+	data, err := ioutil.ReadFile(config)
+	if os.IsNotExist(err) {
+		return dftRemapUser, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	var conf map[string]interface{}
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return "", fmt.Errorf("parse %s failed: %v", config, err)
+	}
+	remap, _ := conf[keyUsernsRemap].(string)
+	remapUser := strings.Split(remap, sepColon)[0]
+	if remapUser == "" || remapUser == "default" {
+		return dftRemapUser, nil
+	}
+	return remapUser, nil
+}
+
+// lookupSubIDRange looks up the subordinate id range of the user, the user
+// can be referred by name or id in the file.
+func lookupSubIDRange(file, name string) (*idRange, error) {
+	names := map[string]bool{name: true}
+	if u, err := suser.LookupUser(name); err == nil {
+		names[strconv.Itoa(u.UID)] = true
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(strings.TrimSpace(scanner.Text()), sepColon)
+		if len(fields) != 3 || !names[fields[0]] {
+			continue
+		}
+		start, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid subordinate id in %s: %v", file, err)
+		}
+		count, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid subordinate id count in %s: %v", file, err)
+		}
+		return &idRange{Start: start, Count: count}, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("no subordinate id defined for %s in %s", name, file)
+}
+
+// checkUsernsRemap ensures containers run in secure mode only when Docker
+// userns-remap is enabled, unless it is waived by policy.
+func (s *Socker) checkUsernsRemap() error {
+	if s.remapErr == nil || s.policy.WaiveUsernsRemap {
+		return nil
+	}
+	if ExitCode(s.remapErr) == ExitCodeError {
+		return failed(fmt.Errorf("detect userns-remap failed: %v", s.remapErr))
+	}
+	return fmt.Errorf("refuse to run in secure mode: %v", s.remapErr)
+}
@@ -0,0 +1,752 @@
+// Copyright (c) 2018 China-HPC.
+
+package socker
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/China-HPC/go-socker/pkg/su"
+	suser "github.com/China-HPC/go-socker/pkg/user"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	permRead  = 04
+	permWrite = 02
+	permExec  = 01
+
+	mountBind   = "bind"
+	mountVolume = "volume"
+	mountTmpfs  = "tmpfs"
+	// dftMaxTmpfsSize is the default size cap of tmpfs mounts.
+	dftMaxTmpfsSize = "1g"
+	readdirBatch    = 1024
+	// the named volumes of users are prefixed and created by the local
+	// driver without options.
+	namedVolumePrefix = "socker_"
+	volumeDriverLocal = "local"
+)
+
+var volumeNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// volume represents a mount specified by -v, --mount or --tmpfs option.
+type volume struct {
+	Type      string
+	Source    string
+	Target    string
+	ReadOnly  bool
+	TmpfsSize int64
+	TmpfsMode string
+	// file is the bind source opened by the check.
+	file *os.File
+}
+
+// boundSource is a checked bind source, docker mounts it by the magic link
+// of the file descriptor held by socker, so the checked file is mounted even
+// if its path is replaced after the check.
+type boundSource struct {
+	file *os.File
+	// spec is the mount spec with the canonical source for audit.
+	spec string
+}
+
+// boundPath returns the path of the file descriptor which is resolvable by
+// the Docker daemon.
+func boundPath(f *os.File) string {
+	return fmt.Sprintf("/proc/%d/fd/%d", os.Getpid(), f.Fd())
+}
+
+// String formats the volume as the value of -v option.
+func (v *volume) String() string {
+	if v.ReadOnly {
+		return fmt.Sprintf("%s:%s:ro", v.Source, v.Target)
+	}
+	return fmt.Sprintf("%s:%s", v.Source, v.Target)
+}
+
+// mountSpec formats the volume as the value of --mount option.
+func (v *volume) mountSpec() string {
+	fields := []string{"type=" + v.Type}
+	if v.Type != mountTmpfs {
+		fields = append(fields, "source="+v.Source)
+	}
+	fields = append(fields, "target="+v.Target)
+	if v.ReadOnly {
+		fields = append(fields, "readonly")
+	}
+	if v.TmpfsSize > 0 {
+		fields = append(fields, fmt.Sprintf("tmpfs-size=%d", v.TmpfsSize))
+	}
+	if v.TmpfsMode != "" {
+		fields = append(fields, "tmpfs-mode="+v.TmpfsMode)
+	}
+	return strings.Join(fields, ",")
+}
+
+// validate checks the paths and names of the volume.
+func (v *volume) validate() error {
+	if v.Type != mountTmpfs && v.Source == "" {
+		return fmt.Errorf("source is required")
+	}
+	if !filepath.IsAbs(v.Target) {
+		return fmt.Errorf("target must be an absolute path")
+	}
+	// the volume is passed to Docker as a comma separated --mount option.
+	if strings.Contains(v.Source, ",") || strings.Contains(v.Target, ",") {
+		return fmt.Errorf("comma is not permitted in paths")
+	}
+	switch v.Type {
+	case mountBind:
+		if !filepath.IsAbs(v.Source) {
+			return fmt.Errorf("bind source must be an absolute path")
+		}
+	case mountVolume:
+		if !volumeNamePattern.MatchString(v.Source) {
+			return fmt.Errorf("invalid volume name %s", v.Source)
+		}
+	case mountTmpfs:
+		if v.TmpfsMode != "" {
+			if _, err := strconv.ParseUint(v.TmpfsMode, 8, 32); err != nil {
+				return fmt.Errorf("invalid tmpfs mode %s", v.TmpfsMode)
+			}
+		}
+	default:
+		return fmt.Errorf("mount type %s is not permitted", v.Type)
+	}
+	return nil
+}
+
+// parseVolume parses the value of -v option which is formatted as
+// SOURCE:TARGET[:OPTIONS], the source is a volume name if it is not an
+// absolute path.
+func parseVolume(vol string) (*volume, error) {
+	fields := strings.Split(vol, sepColon)
+	if len(fields) < 2 || len(fields) > 3 {
+		return nil, fmt.Errorf("invalid volume %s", vol)
+	}
+	v := &volume{Type: mountBind, Source: fields[0], Target: fields[1]}
+	if !filepath.IsAbs(v.Source) {
+		v.Type = mountVolume
+	}
+	if len(fields) == 3 {
+		for _, opt := range strings.Split(fields[2], ",") {
+			switch opt {
+			case "ro":
+				v.ReadOnly = true
+			case "rw":
+				v.ReadOnly = false
+			default:
+				return nil, fmt.Errorf("volume %s: option %s is not permitted", vol, opt)
+			}
+		}
+	}
+	if err := v.validate(); err != nil {
+		return nil, fmt.Errorf("volume %s: %v", vol, err)
+	}
+	return v, nil
+}
+
+// parseMount parses the value of --mount option which is formatted as comma
+// separated KEY=VALUE pairs.
+func parseMount(spec string) (*volume, error) {
+	v := &volume{Type: mountVolume}
+	for _, field := range strings.Split(spec, ",") {
+		kv := strings.SplitN(field, "=", 2)
+		key, value := strings.ToLower(kv[0]), ""
+		if len(kv) == 2 {
+			value = kv[1]
+		}
+		switch key {
+		case "type":
+			v.Type = value
+		case "source", "src":
+			v.Source = value
+		case "target", "destination", "dst":
+			v.Target = value
+		case "readonly", "ro":
+			readOnly, err := parseMountBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("mount %s: %v", spec, err)
+			}
+			v.ReadOnly = readOnly
+		case "tmpfs-size":
+			size, err := parseSize(value)
+			if err != nil {
+				return nil, fmt.Errorf("mount %s: %v", spec, err)
+			}
+			v.TmpfsSize = size
+		case "tmpfs-mode":
+			v.TmpfsMode = value
+		case "consistency", "volume-nocopy":
+		default:
+			return nil, fmt.Errorf("mount %s: option %s is not permitted", spec, key)
+		}
+	}
+	if err := v.validate(); err != nil {
+		return nil, fmt.Errorf("mount %s: %v", spec, err)
+	}
+	return v, nil
+}
+
+// parseTmpfs parses the value of --tmpfs option which is formatted as
+// TARGET[:OPTIONS].
+func parseTmpfs(spec string) (*volume, error) {
+	fields := strings.SplitN(spec, sepColon, 2)
+	v := &volume{Type: mountTmpfs, Target: fields[0]}
+	if len(fields) == 2 {
+		for _, opt := range strings.Split(fields[1], ",") {
+			kv := strings.SplitN(opt, "=", 2)
+			switch {
+			case kv[0] == "size" && len(kv) == 2:
+				size, err := parseSize(kv[1])
+				if err != nil {
+					return nil, fmt.Errorf("tmpfs %s: %v", spec, err)
+				}
+				v.TmpfsSize = size
+			case kv[0] == "mode" && len(kv) == 2:
+				v.TmpfsMode = kv[1]
+			case kv[0] == "ro":
+				v.ReadOnly = true
+			case kv[0] == "rw", kv[0] == "noexec", kv[0] == "nosuid", kv[0] == "nodev":
+			default:
+				return nil, fmt.Errorf("tmpfs %s: option %s is not permitted", spec, opt)
+			}
+		}
+	}
+	if err := v.validate(); err != nil {
+		return nil, fmt.Errorf("tmpfs %s: %v", spec, err)
+	}
+	return v, nil
+}
+
+func parseMountBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "", "1", "true":
+		return true, nil
+	case "0", "false":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid boolean value %s", value)
+}
+
+// parseSize parses a human readable size such as 64m into bytes, the units
+// are binary as Docker does.
+func parseSize(size string) (int64, error) {
+	s := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(size)), "b")
+	unit := int64(1)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'k':
+			unit = 1 << 10
+		case 'm':
+			unit = 1 << 20
+		case 'g':
+			unit = 1 << 30
+		case 't':
+			unit = 1 << 40
+		}
+		if unit > 1 {
+			s = s[:n-1]
+		}
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %s", size)
+	}
+	return int64(value * float64(unit)), nil
+}
+
+// credential represents the identity which the mount permissions are
+// checked against, it is the real user rather than the effective user of
+// socker process.
+type credential struct {
+	uid  uint32
+	gids map[uint32]bool
+}
+
+func (s *Socker) callerCredential() (*credential, error) {
+	uid, err := strconv.ParseUint(s.CurrentUID, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	cred := &credential{uid: uint32(uid), gids: make(map[uint32]bool)}
+	gid, err := strconv.ParseUint(s.currentGID, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	cred.gids[uint32(gid)] = true
+	if ucred, err := suser.GetUserCredByUID(s.CurrentUID); err == nil {
+		for _, id := range ucred.Groups {
+			cred.gids[uint32(id)] = true
+		}
+	}
+	return cred, nil
+}
+
+// permits reports whether the credential has the wanted permission of a
+// file by the access check of access(2), the entries of its POSIX ACL are
+// evaluated as the kernel does, acl is nil if the file has only the owner,
+// group and mode bits.
+func (c *credential) permits(uid, gid, mode uint32, acl []aclEntry, want uint32) bool {
+	if c.uid == 0 {
+		return true
+	}
+	if uid == c.uid {
+		return (mode>>6)&want == want
+	}
+	if acl == nil {
+		if c.gids[gid] {
+			return (mode>>3)&want == want
+		}
+		return mode&want == want
+	}
+	// the group bits of mode are the mask if the file has an ACL.
+	mask := uint32(07)
+	for _, e := range acl {
+		if e.Tag == aclMask {
+			mask = e.Perm
+		}
+	}
+	for _, e := range acl {
+		if e.Tag == aclUser && e.ID == c.uid {
+			return e.Perm&mask&want == want
+		}
+	}
+	matched := false
+	for _, e := range acl {
+		if (e.Tag == aclGroupObj && c.gids[gid]) || (e.Tag == aclGroup && c.gids[e.ID]) {
+			if e.Perm&mask&want == want {
+				return true
+			}
+			matched = true
+		}
+	}
+	if matched {
+		return false
+	}
+	return mode&want == want
+}
+
+// readable reports whether the credential can read the file, a directory
+// must be searchable too.
+func (c *credential) readable(uid, gid, mode uint32, acl []aclEntry) bool {
+	want := uint32(permRead)
+	if mode&unix.S_IFMT == unix.S_IFDIR {
+		want |= permExec
+	}
+	return c.permits(uid, gid, mode, acl, want)
+}
+
+// openPath opens the canonical path with O_PATH|O_NOFOLLOW component by
+// component, so it fails if any component has been replaced by a symlink
+// after the path was resolved. Every directory on the path must be
+// searchable by the credential.
+//
+// The opened file is returned, it must be closed by the caller.
+func (c *credential) openPath(canonical string) (*os.File, *unix.Stat_t, error) {
+	fd, err := unix.Open("/", unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	stat, err := c.walkPath(&fd, canonical)
+	if err != nil {
+		unix.Close(fd)
+		return nil, nil, err
+	}
+	return os.NewFile(uintptr(fd), canonical), stat, nil
+}
+
+// walkPath opens the components of canonical path from the directory fd,
+// fd is replaced by the file descriptor of each component.
+func (c *credential) walkPath(fd *int, canonical string) (*unix.Stat_t, error) {
+	stat := &unix.Stat_t{}
+	if err := unix.Fstat(*fd, stat); err != nil {
+		return nil, err
+	}
+	for _, name := range strings.Split(strings.Trim(canonical, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		if stat.Mode&unix.S_IFMT != unix.S_IFDIR {
+			return nil, fmt.Errorf("%s: not a directory", canonical)
+		}
+		acl, err := readACL(fdPath(*fd), true)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", canonical, err)
+		}
+		if !c.permits(stat.Uid, stat.Gid, stat.Mode, acl, permExec) {
+			return nil, fmt.Errorf("%s: permission denied", canonical)
+		}
+		next, err := unix.Openat(*fd, name,
+			unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", canonical, err)
+		}
+		unix.Close(*fd)
+		*fd = next
+		if err := unix.Fstat(*fd, stat); err != nil {
+			return nil, err
+		}
+		if stat.Mode&unix.S_IFMT == unix.S_IFLNK {
+			return nil, fmt.Errorf("%s: path changed while checking", canonical)
+		}
+	}
+	return stat, nil
+}
+
+// checkMounts checks the mounts specified by -v, --mount and --tmpfs options
+// and rewrites them as --mount options, with canonical bind sources, owner
+// prefixed volume names and capped tmpfs sizes.
+func (s *Socker) checkMounts(opts *Opts) error {
+	var vols []*volume
+	for _, vol := range opts.Volumes {
+		v, err := parseVolume(vol)
+		if err != nil {
+			return err
+		}
+		vols = append(vols, v)
+	}
+	for _, spec := range opts.Mounts {
+		v, err := parseMount(spec)
+		if err != nil {
+			return err
+		}
+		vols = append(vols, v)
+	}
+	for _, spec := range opts.Tmpfs {
+		v, err := parseTmpfs(spec)
+		if err != nil {
+			return err
+		}
+		vols = append(vols, v)
+	}
+	cred, err := s.callerCredential()
+	if err != nil {
+		return failed(err)
+	}
+	var specs []string
+	for _, v := range vols {
+		switch v.Type {
+		case mountBind:
+			err = s.checkBind(cred, v)
+		case mountVolume:
+			err = s.prepareNamedVolume(v)
+		case mountTmpfs:
+			err = s.checkTmpfs(v)
+		}
+		if ExitCode(err) == ExitCodeError {
+			return failed(fmt.Errorf("mount %s: %v", v.Target, err))
+		}
+		if err != nil {
+			return fmt.Errorf("mount %s %v", v.Target, err)
+		}
+		if v.file != nil {
+			b := &boundSource{file: v.file, spec: v.mountSpec()}
+			v.Source = boundPath(v.file)
+			if s.binds == nil {
+				s.binds = make(map[string]*boundSource)
+			}
+			s.binds[v.mountSpec()] = b
+		}
+		specs = append(specs, v.mountSpec())
+	}
+	opts.Volumes, opts.Tmpfs, opts.Mounts = nil, nil, specs
+	return nil
+}
+
+// releaseBinds closes the bind sources held by checkMounts.
+func (s *Socker) releaseBinds() {
+	for _, b := range s.binds {
+		b.file.Close()
+	}
+	s.binds = nil
+}
+
+// auditedMounts replaces the held bind sources in the mounts with their
+// canonical paths.
+func (s *Socker) auditedMounts(mounts []string) []string {
+	audited := make([]string, 0, len(mounts))
+	for _, mount := range mounts {
+		if b, ok := s.binds[mount]; ok {
+			mount = b.spec
+		}
+		audited = append(audited, mount)
+	}
+	return audited
+}
+
+// checkBind checks the bind source is permitted to be mounted and replaces
+// it with the canonical path, the checked source is held open by the file
+// of volume if it is permitted. A bind mount can be writable only if its
+// source is under the writable prefixes defined by policy and is owned by or
+// writable for current user.
+//
+// Only the mount root and its path components are checked by default, so
+// the check stays fast on huge trees. The files inside are checked if the
+// deep check is enabled by policy, within its bounds.
+func (s *Socker) checkBind(cred *credential, v *volume) error {
+	canonical, err := filepath.EvalSymlinks(v.Source)
+	if err != nil {
+		return err
+	}
+	f, stat, err := cred.openPath(canonical)
+	if err != nil {
+		return fmt.Errorf("permission denied: %v", err)
+	}
+	acl, err := readACL(fdPath(int(f.Fd())), true)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := s.checkBindSource(cred, canonical, stat, acl, v.ReadOnly); err != nil {
+		f.Close()
+		return err
+	}
+	v.Source = canonical
+	v.file = f
+	return nil
+}
+
+func (s *Socker) checkBindSource(cred *credential, canonical string, stat *unix.Stat_t, acl []aclEntry, readOnly bool) error {
+	if !cred.readable(stat.Uid, stat.Gid, stat.Mode, acl) {
+		return fmt.Errorf("permission denied")
+	}
+	if !readOnly {
+		if !s.isWritablePrefix(canonical) {
+			return fmt.Errorf("must mounted as read-only")
+		}
+		if stat.Uid != cred.uid && !cred.permits(stat.Uid, stat.Gid, stat.Mode, acl, permWrite) {
+			return fmt.Errorf("is not writable")
+		}
+	}
+	if stat.Mode&unix.S_IFMT != unix.S_IFDIR {
+		return nil
+	}
+	return s.deepCheck(cred, canonical)
+}
+
+// deepCheck checks the files in the directory are readable breadth first,
+// it stops when the entries or depth exceed the bounds of policy.
+func (s *Socker) deepCheck(cred *credential, dir string) error {
+	bounds := s.policy.VolumeDeepCheck
+	if bounds.MaxEntries <= 0 {
+		return nil
+	}
+	type entry struct {
+		path  string
+		depth int
+	}
+	queue := []entry{{path: dir, depth: 1}}
+	checked := 0
+	for len(queue) > 0 {
+		e := queue[0]
+		queue = queue[1:]
+		f, err := os.Open(e.path)
+		if err != nil {
+			return fmt.Errorf("%s permission denied: %v", e.path, err)
+		}
+		for {
+			infos, err := f.Readdir(readdirBatch)
+			for _, info := range infos {
+				if checked >= bounds.MaxEntries {
+					f.Close()
+					s.logger().Debugf("deep check of %s stopped after %d entries", dir, checked)
+					return nil
+				}
+				checked++
+				stat, ok := info.Sys().(*syscall.Stat_t)
+				if !ok || info.Mode()&os.ModeSymlink != 0 {
+					continue
+				}
+				p := filepath.Join(e.path, info.Name())
+				acl, err := readACL(p, false)
+				if err != nil {
+					f.Close()
+					return fmt.Errorf("%s %v", p, err)
+				}
+				if !cred.readable(stat.Uid, stat.Gid, stat.Mode, acl) {
+					f.Close()
+					return fmt.Errorf("%s permission denied", p)
+				}
+				if info.IsDir() && (bounds.MaxDepth <= 0 || e.depth < bounds.MaxDepth) {
+					queue = append(queue, entry{path: p, depth: e.depth + 1})
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+		f.Close()
+	}
+	return nil
+}
+
+// prepareNamedVolume maps the volume name into the namespace of current
+// user, the volume is created with owner label if it does not exist, and it
+// can't be mounted by other users.
+func (s *Socker) prepareNamedVolume(v *volume) error {
+	name := fmt.Sprintf("%s%s_%s", namedVolumePrefix, s.CurrentUID, v.Source)
+	output, err := su.Output(s.dockerUID, cmdDocker, "volume", "inspect",
+		"--format", fmt.Sprintf("{{.Driver}}|{{json .Options}}|{{index .Labels %q}}",
+			labelOwner), name)
+	if err != nil {
+		s.logger().Debugf("create volume %s: %v", name, err)
+		_, err = su.CombinedOutput(s.dockerUID, cmdDocker, "volume", "create",
+			"--driver", volumeDriverLocal,
+			"--label", fmt.Sprintf("%s=%s", labelOwner, s.CurrentUID), name)
+		if err != nil {
+			return failed(err)
+		}
+	} else if err := s.checkNamedVolume(name, string(output)); err != nil {
+		return err
+	}
+	v.Source = name
+	return nil
+}
+
+// checkNamedVolume checks the driver, options and owner label of the existing
+// volume inspected as "driver|options|owner". The label can be set by anyone
+// who creates volumes by the Docker API, and the options of the local driver
+// can bind any host path, so only the volumes without options are trusted.
+func (s *Socker) checkNamedVolume(name, inspected string) error {
+	fields := strings.Split(strings.TrimSpace(inspected), sepPipe)
+	if len(fields) != 3 || fields[0] != volumeDriverLocal {
+		return fmt.Errorf("volume %s is not a volume of the %s driver", name, volumeDriverLocal)
+	}
+	if fields[1] != "null" && fields[1] != "{}" {
+		return fmt.Errorf("volume %s with driver options is not permitted", name)
+	}
+	if fields[2] != s.CurrentUID {
+		return fmt.Errorf("volume %s is not owned by %s", name, s.currentUser)
+	}
+	return nil
+}
+
+// checkTmpfs caps the tmpfs size by policy, the max size is used if it is
+// not specified.
+func (s *Socker) checkTmpfs(v *volume) error {
+	max, err := parseSize(s.policy.MaxTmpfsSize)
+	if err != nil {
+		return fmt.Errorf("invalid max tmpfs size of policy: %v", err)
+	}
+	if v.TmpfsSize == 0 {
+		v.TmpfsSize = max
+	}
+	if v.TmpfsSize > max {
+		return fmt.Errorf("tmpfs size exceeds the limit %s", s.policy.MaxTmpfsSize)
+	}
+	return nil
+}
+
+// isWritablePrefix reports whether the canonical path is under one of the
+// writable prefixes defined by policy.
+func (s *Socker) isWritablePrefix(canonical string) bool {
+	for _, prefix := range s.policy.WritableMountPrefixes {
+		prefix, err := filepath.EvalSymlinks(prefix)
+		if err != nil {
+			s.logger().Debugf("resolve writable prefix failed: %v", err)
+			continue
+		}
+		if canonical == prefix || strings.HasPrefix(canonical, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultMounts returns the site default mounts for the image with the
+// variables substituted. The mounts are skipped if a variable is undefined,
+// the source does not exist, the image opts out or the target is mounted by
+// user already.
+func (s *Socker) defaultMounts(image string, opts *Opts) []string {
+	if len(s.policy.DefaultMounts) == 0 {
+		return nil
+	}
+	skipped := make(map[string]bool)
+	if images, err := loadImages(dftImageConfigFile); err == nil {
+		if img, ok := findImage(images, image); ok {
+			for _, target := range img.SkipDefaultMounts {
+				skipped[target] = true
+			}
+		}
+	}
+	if skipped["*"] {
+		return nil
+	}
+	for _, vol := range opts.Volumes {
+		if v, err := parseVolume(vol); err == nil {
+			skipped[v.Target] = true
+		}
+	}
+	for _, spec := range opts.Mounts {
+		if v, err := parseMount(spec); err == nil {
+			skipped[v.Target] = true
+		}
+	}
+	for _, spec := range opts.Tmpfs {
+		if v, err := parseTmpfs(spec); err == nil {
+			skipped[v.Target] = true
+		}
+	}
+	var vols []string
+	for _, mount := range s.policy.DefaultMounts {
+		undefined := false
+		vol := os.Expand(mount, func(key string) string {
+			value := s.mountVar(key)
+			// the Slurm variables are defined by user, they must not change
+			// the mount options or escape from the directory.
+			if value == "" || strings.Contains(value, sepColon) ||
+				strings.Contains(value, "..") {
+				undefined = true
+			}
+			return value
+		})
+		if undefined {
+			s.logger().Debugf("skip default mount %s: undefined variable", mount)
+			continue
+		}
+		v, err := parseVolume(vol)
+		if err != nil {
+			s.logger().Warnf("invalid default mount %s: %v", mount, err)
+			continue
+		}
+		if skipped[v.Target] {
+			continue
+		}
+		if v.Type == mountBind {
+			if _, err := os.Stat(v.Source); os.IsNotExist(err) {
+				s.logger().Debugf("skip default mount %s: source does not exist", vol)
+				continue
+			}
+		}
+		vols = append(vols, vol)
+	}
+	return vols
+}
+
+// mountVar returns the value of the variable in default mounts, they are
+// the information of current user and the Slurm variables of the job.
+func (s *Socker) mountVar(key string) string {
+	switch key {
+	case "USER":
+		return s.currentUser
+	case "UID":
+		return s.CurrentUID
+	case "GID":
+		return s.currentGID
+	case "GROUP":
+		return s.currentGroup
+	case "HOME":
+		return s.homeDir
+	}
+	if strings.HasPrefix(key, "SLURM_") {
+		return lookupEnv(s.environ, key)
+	}
+	return ""
+}
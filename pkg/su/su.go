@@ -2,6 +2,7 @@ package su
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"os/exec"
 	"syscall"
@@ -9,15 +10,24 @@ import (
 	"github.com/China-HPC/go-socker/pkg/user"
 )
 
-// Command creates a new exec.Cmd that will run with user privilege.
+// Command creates a new exec.Cmd that will run with user privilege, the
+// environment of the calling process is not inherited, e.g. DOCKER_HOST of a
+// setuid caller can't point docker to another daemon.
 func Command(uid, command string, args ...string) (*exec.Cmd, error) {
+	return CommandContext(context.Background(), uid, command, args...)
+}
+
+// CommandContext is like Command but the process is killed if the context
+// is done before the command completes.
+func CommandContext(ctx context.Context, uid, command string, args ...string) (*exec.Cmd, error) {
 	ucred, err := user.GetUserCredByUID(uid)
 	if err != nil {
 		return nil, err
 	}
-	cmd := exec.Command(command, args...)
+	cmd := exec.CommandContext(ctx, command, args...)
 	cmd.SysProcAttr = &syscall.SysProcAttr{}
 	cmd.SysProcAttr.Credential = ucred.Cred
+	cmd.Env = []string{}
 	return cmd, nil
 }
 
@@ -31,7 +41,7 @@ func Run(uid, command string, args ...string) error {
 	cmd.Stderr = &stderr
 	err = cmd.Run()
 	if err != nil {
-		return fmt.Errorf("command(su %d) %s: %v: %s",
+		return fmt.Errorf("command(su %s) %s: %v: %s",
 			uid, cmd.Path, err, stderr.String())
 	}
 	return nil
@@ -47,7 +57,7 @@ func Output(uid, command string, args ...string) ([]byte, error) {
 	cmd.Stderr = &stderr
 	out, err := cmd.Output()
 	if err != nil {
-		return nil, fmt.Errorf("command(su %d) %s: %v: %s (output: %s)",
+		return nil, fmt.Errorf("command(su %s) %s: %v: %s (output: %s)",
 			uid, cmd.Path, err, stderr.String(), string(out))
 	}
 	return out, nil
@@ -62,7 +72,7 @@ func CombinedOutput(uid, command string, args ...string) ([]byte, error) {
 	}
 	out, err := cmd.CombinedOutput()
 	if err != nil {
-		return nil, fmt.Errorf("command(su %d) %s: %v: %s",
+		return nil, fmt.Errorf("command(su %s) %s: %v: %s",
 			uid, cmd.Path, err, string(out))
 	}
 	return out, nil
@@ -0,0 +1,302 @@
+package user
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+const (
+	dbPasswd     = "passwd"
+	dbGroup      = "group"
+	dbInitgroups = "initgroups"
+	// getent exits with 2 if the key could not be found in the database.
+	exitGetentNotFound = 2
+)
+
+// getentPaths are the trusted locations of getent, it is never looked up
+// in PATH as socker runs with setuid.
+var getentPaths = []string{"/usr/bin/getent", "/bin/getent"}
+
+var errNoGetent = errors.New("getent not found")
+
+// UnknownUserError is returned by LookupUser and LookupUserID when a user
+// cannot be found.
+type UnknownUserError string
+
+func (e UnknownUserError) Error() string {
+	return "unknown user " + string(e)
+}
+
+// UnknownGroupError is returned by LookupGroup and LookupGroupID when a group
+// cannot be found.
+type UnknownGroupError string
+
+func (e UnknownGroupError) Error() string {
+	return "unknown group " + string(e)
+}
+
+// LookupUser looks up a user by name. The users are resolved by the Name
+// Service Switch through getent, so the users from LDAP or SSSD are found
+// even in static builds, /etc/passwd is read if getent is unavailable.
+func LookupUser(name string) (*User, error) {
+	u, err := lookupUser(name)
+	if err != nil {
+		return nil, err
+	}
+	// getent looks up numeric keys by UID.
+	if u.Name != name {
+		return nil, UnknownUserError(name)
+	}
+	return u, nil
+}
+
+// LookupUserID looks up a user by UID.
+func LookupUserID(uid int) (*User, error) {
+	key := strconv.Itoa(uid)
+	u, err := lookupUser(key)
+	if err != nil {
+		return nil, err
+	}
+	if u.UID != uid {
+		return nil, UnknownUserError(key)
+	}
+	return u, nil
+}
+
+// LookupGroup looks up a group by name.
+func LookupGroup(name string) (*Group, error) {
+	g, err := lookupGroup(name)
+	if err != nil {
+		return nil, err
+	}
+	if g.Name != name {
+		return nil, UnknownGroupError(name)
+	}
+	return g, nil
+}
+
+// LookupGroupID looks up a group by GID.
+func LookupGroupID(gid int) (*Group, error) {
+	key := strconv.Itoa(gid)
+	g, err := lookupGroup(key)
+	if err != nil {
+		return nil, err
+	}
+	if g.GID != gid {
+		return nil, UnknownGroupError(key)
+	}
+	return g, nil
+}
+
+// GroupIDs returns the GIDs of all groups the user is a member of, the
+// primary group is the first one.
+func (u *User) GroupIDs() ([]int, error) {
+	gids := []int{u.GID}
+	seen := map[int]bool{u.GID: true}
+	add := func(id string) error {
+		gid, err := strconv.Atoi(id)
+		if err != nil {
+			return fmt.Errorf("invalid gid %q of user %s", id, u.Name)
+		}
+		if !seen[gid] {
+			seen[gid] = true
+			gids = append(gids, gid)
+		}
+		return nil
+	}
+	lines, err := getent(dbInitgroups, u.Name)
+	if err == errNoGetent {
+		hostUser, err := user.Lookup(u.Name)
+		if err != nil {
+			return nil, err
+		}
+		ids, err := hostUser.GroupIds()
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			if err := add(id); err != nil {
+				return nil, err
+			}
+		}
+		return gids, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// the output is the user name followed by the GIDs.
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		for _, id := range fields[1:] {
+			if err := add(id); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return gids, nil
+}
+
+func lookupUser(key string) (*User, error) {
+	lines, err := getent(dbPasswd, key)
+	if err == errNoGetent {
+		return lookupUserFromFile(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return nil, UnknownUserError(key)
+	}
+	return parsePasswdEntry(lines[0])
+}
+
+func lookupGroup(key string) (*Group, error) {
+	lines, err := getent(dbGroup, key)
+	if err == errNoGetent {
+		return lookupGroupFromFile(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return nil, UnknownGroupError(key)
+	}
+	return parseGroupEntry(lines[0])
+}
+
+// passwdFile is read if getent is unavailable.
+var passwdFile = "/etc/passwd"
+
+// lookupUserFromFile looks up user in /etc/passwd, the numeric key is
+// looked up by UID as getent does.
+func lookupUserFromFile(key string) (*User, error) {
+	f, err := os.Open(passwdFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	field := 0
+	if _, err := strconv.Atoi(key); err == nil {
+		field = 2
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) > field && fields[field] == key {
+			return parsePasswdEntry(line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, UnknownUserError(key)
+}
+
+// lookupGroupFromFile looks up group by os/user, the members are not filled.
+func lookupGroupFromFile(key string) (*Group, error) {
+	var g *user.Group
+	var err error
+	if _, convErr := strconv.Atoi(key); convErr == nil {
+		g, err = user.LookupGroupId(key)
+	} else {
+		g, err = user.LookupGroup(key)
+	}
+	if err != nil {
+		return nil, UnknownGroupError(key)
+	}
+	gid, err := strconv.Atoi(g.Gid)
+	if err != nil {
+		return nil, err
+	}
+	return &Group{GID: gid, Name: g.Name}, nil
+}
+
+// getent queries the database by getent and returns the output lines, no
+// lines are returned if the keys could not be found.
+func getent(database string, keys ...string) ([]string, error) {
+	path := ""
+	for _, p := range getentPaths {
+		if info, err := os.Stat(p); err == nil && !info.IsDir() {
+			path = p
+			break
+		}
+	}
+	if path == "" {
+		return nil, errNoGetent
+	}
+	cmd := exec.Command(path, append([]string{database}, keys...)...)
+	// the environment of user such as LD_PRELOAD must not be inherited.
+	cmd.Env = []string{}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if exitErr, ok := err.(*exec.ExitError); ok &&
+		exitErr.ExitCode() == exitGetentNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("getent %s %v: %v: %s", database, keys, err,
+			stderr.String())
+	}
+	var lines []string
+	for _, line := range strings.Split(string(output), "\n") {
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+// parsePasswdEntry parses an entry in the format of /etc/passwd.
+func parsePasswdEntry(line string) (*User, error) {
+	fields := strings.Split(line, ":")
+	if len(fields) != 7 {
+		return nil, fmt.Errorf("invalid passwd entry %q", line)
+	}
+	uid, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid passwd entry %q", line)
+	}
+	gid, err := strconv.Atoi(fields[3])
+	if err != nil {
+		return nil, fmt.Errorf("invalid passwd entry %q", line)
+	}
+	return &User{
+		UID:   uid,
+		GID:   gid,
+		Name:  fields[0],
+		Home:  fields[5],
+		Shell: fields[6],
+	}, nil
+}
+
+// parseGroupEntry parses an entry in the format of /etc/group.
+func parseGroupEntry(line string) (*Group, error) {
+	fields := strings.Split(line, ":")
+	if len(fields) != 4 {
+		return nil, fmt.Errorf("invalid group entry %q", line)
+	}
+	gid, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid group entry %q", line)
+	}
+	g := &Group{GID: gid, Name: fields[0]}
+	if fields[3] != "" {
+		g.Users = strings.Split(fields[3], ",")
+	}
+	return g, nil
+}
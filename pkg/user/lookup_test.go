@@ -0,0 +1,129 @@
+package user
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLookupUser(t *testing.T) {
+	Convey("Test NSS aware user lookup", t, func() {
+		u, err := LookupUser("root")
+		So(err, ShouldBeNil)
+		So(u.UID, ShouldEqual, 0)
+		So(u.Home, ShouldEqual, "/root")
+		gids, err := u.GroupIDs()
+		So(err, ShouldBeNil)
+		So(gids[0], ShouldEqual, u.GID)
+		u, err = LookupUserID(0)
+		So(err, ShouldBeNil)
+		So(u.Name, ShouldEqual, "root")
+		g, err := LookupGroupID(0)
+		So(err, ShouldBeNil)
+		So(g.Name, ShouldEqual, "root")
+		_, err = LookupUser("socker-no-such-user")
+		So(err, ShouldHaveSameTypeAs, UnknownUserError(""))
+		_, err = LookupGroup("0")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestLookupUserFromFile(t *testing.T) {
+	Convey("Test user lookup in passwd file", t, func() {
+		dir, err := ioutil.TempDir("", "passwd")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		file := path.Join(dir, "passwd")
+		So(ioutil.WriteFile(file, []byte("# users\n"+
+			"root:x:0:0:root:/root:/bin/bash\n"+
+			"1000:x:1001:1001::/home/1000:/bin/sh\n"+
+			"alice:x:1000:100:Alice:/home/alice:/bin/zsh\n"), 0644), ShouldBeNil)
+		defer func(file string) { passwdFile = file }(passwdFile)
+		passwdFile = file
+
+		u, err := lookupUserFromFile("alice")
+		So(err, ShouldBeNil)
+		So(u, ShouldResemble, &User{UID: 1000, GID: 100, Name: "alice",
+			Home: "/home/alice", Shell: "/bin/zsh"})
+		// the numeric key is a UID.
+		u, err = lookupUserFromFile("1000")
+		So(err, ShouldBeNil)
+		So(u.Name, ShouldEqual, "alice")
+		_, err = lookupUserFromFile("bob")
+		So(err, ShouldHaveSameTypeAs, UnknownUserError(""))
+	})
+}
+
+func TestGetUserCred(t *testing.T) {
+	Convey("Test user credential", t, func() {
+		cred, err := GetUserCredByUID("0")
+		So(err, ShouldBeNil)
+		So(cred.Name, ShouldEqual, "root")
+		So(cred.Cred.Gid, ShouldEqual, uint32(cred.GID))
+		So(cred.Groups[0], ShouldEqual, cred.GID)
+		So(cred.Cred.Groups, ShouldHaveLength, len(cred.Groups))
+		cached, err := GetUserCred("root")
+		So(err, ShouldBeNil)
+		So(cached, ShouldEqual, cred)
+		_, err = GetUserCredByUID("root")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestParsePasswdEntry(t *testing.T) {
+	Convey("Test parsing passwd entries", t, func() {
+		cases := []struct {
+			line string
+			user *User
+		}{
+			{"alice:x:1000:100:Alice:/home/alice:/bin/bash",
+				&User{UID: 1000, GID: 100, Name: "alice", Home: "/home/alice", Shell: "/bin/bash"}},
+			{"nobody:x:65534:65534::/:", &User{UID: 65534, GID: 65534, Name: "nobody", Home: "/"}},
+			{"alice:x:1000:100:Alice:/home/alice", nil},
+			{"alice:x:1000:100:Alice:/home/alice:/bin/bash:extra", nil},
+			{"", nil},
+			{"alice:x:abc:100:Alice:/home/alice:/bin/bash", nil},
+			{"alice:x:1000:abc:Alice:/home/alice:/bin/bash", nil},
+			{"alice:x::100:Alice:/home/alice:/bin/bash", nil},
+		}
+		for _, c := range cases {
+			u, err := parsePasswdEntry(c.line)
+			if c.user == nil {
+				So(err, ShouldNotBeNil)
+				continue
+			}
+			So(err, ShouldBeNil)
+			So(u, ShouldResemble, c.user)
+			So(u.PasswdEntry(), ShouldStartWith, c.user.Name+":x:")
+		}
+	})
+}
+
+func TestParseGroupEntry(t *testing.T) {
+	Convey("Test parsing group entries", t, func() {
+		cases := []struct {
+			line  string
+			group *Group
+		}{
+			{"users:x:100:alice,bob", &Group{GID: 100, Name: "users", Users: []string{"alice", "bob"}}},
+			{"empty:x:200:", &Group{GID: 200, Name: "empty"}},
+			{"users:x:100", nil},
+			{"users:x:100:alice:extra", nil},
+			{"", nil},
+			{"users:x:abc:alice", nil},
+			{"users:x::alice", nil},
+		}
+		for _, c := range cases {
+			g, err := parseGroupEntry(c.line)
+			if c.group == nil {
+				So(err, ShouldNotBeNil)
+				continue
+			}
+			So(err, ShouldBeNil)
+			So(g, ShouldResemble, c.group)
+		}
+	})
+}
@@ -0,0 +1,101 @@
+package user
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	dbShadow   = "shadow"
+	shadowFile = "/etc/shadow"
+	day        = 24 * time.Hour
+)
+
+// shadowEntry is the part of an /etc/shadow entry used to validate account.
+type shadowEntry struct {
+	password string
+	// expire is the days since epoch the account expires, -1 if never.
+	expire int
+}
+
+// isLocked reports whether the password is locked by usermod -L or passwd -l,
+// which prefix the hash with "!". The bare "!" and "!!" of the accounts never
+// had a password are not locked as they may login by keys.
+func (e *shadowEntry) isLocked() bool {
+	if !strings.HasPrefix(e.password, "!") {
+		return false
+	}
+	hash := strings.TrimLeft(e.password, "!")
+	return hash != "" && hash != "*"
+}
+
+func (e *shadowEntry) isExpired(now time.Time) bool {
+	return e.expire >= 0 && int(now.Unix()/int64(day/time.Second)) >= e.expire
+}
+
+// validate returns a DisabledAccountError if the account is locked or has
+// expired at now.
+func (e *shadowEntry) validate(name string, now time.Time) error {
+	if e.isLocked() {
+		return &DisabledAccountError{Name: name, Reason: "is locked"}
+	}
+	if e.isExpired(now) {
+		return &DisabledAccountError{Name: name, Reason: "has expired"}
+	}
+	return nil
+}
+
+// lookupShadow looks up the shadow entry of user, nil is returned if it is
+// not found.
+func lookupShadow(name string) (*shadowEntry, error) {
+	lines, err := getent(dbShadow, name)
+	if err == errNoGetent {
+		return lookupShadowFromFile(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return nil, nil
+	}
+	return parseShadowEntry(lines[0])
+}
+
+func lookupShadowFromFile(name string) (*shadowEntry, error) {
+	f, err := os.Open(shadowFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), name+":") {
+			return parseShadowEntry(scanner.Text())
+		}
+	}
+	return nil, scanner.Err()
+}
+
+// parseShadowEntry parses an entry in the format of /etc/shadow.
+func parseShadowEntry(line string) (*shadowEntry, error) {
+	fields := strings.Split(line, ":")
+	if len(fields) != 9 {
+		return nil, fmt.Errorf("invalid shadow entry of %s", fields[0])
+	}
+	entry := &shadowEntry{password: fields[1], expire: -1}
+	if fields[7] != "" {
+		expire, err := strconv.Atoi(fields[7])
+		if err != nil {
+			return nil, fmt.Errorf("invalid shadow entry of %s", fields[0])
+		}
+		entry.expire = expire
+	}
+	return entry, nil
+}
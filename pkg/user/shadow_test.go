@@ -0,0 +1,76 @@
+package user
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestParseShadowEntry(t *testing.T) {
+	Convey("Test parsing shadow entries", t, func() {
+		cases := []struct {
+			line  string
+			entry *shadowEntry
+		}{
+			{"alice:$6$salt$hash:19000:0:99999:7:::", &shadowEntry{password: "$6$salt$hash", expire: -1}},
+			{"alice:$6$salt$hash:19000:0:99999:7::20000:", &shadowEntry{password: "$6$salt$hash", expire: 20000}},
+			{"alice::::::::", &shadowEntry{expire: -1}},
+			{"alice:*:19000:0:99999:7:::", &shadowEntry{password: "*", expire: -1}},
+			{"alice:$6$salt$hash:19000:0:99999:7::never:", nil},
+			{"alice:$6$salt$hash:19000", nil},
+			{"alice:$6$salt$hash:19000:0:99999:7:::extra:", nil},
+		}
+		for _, c := range cases {
+			entry, err := parseShadowEntry(c.line)
+			if c.entry == nil {
+				So(err, ShouldNotBeNil)
+				continue
+			}
+			So(err, ShouldBeNil)
+			So(entry, ShouldResemble, c.entry)
+		}
+	})
+}
+
+func TestValidateShadowEntry(t *testing.T) {
+	Convey("Test locked and expired accounts", t, func() {
+		now := time.Unix(20000*int64(day/time.Second)+3600, 0)
+		cases := []struct {
+			password string
+			expire   int
+			reason   string
+		}{
+			{"$6$salt$hash", -1, ""},
+			{"", -1, ""},
+			// the accounts never had a password may login by keys.
+			{"!", -1, ""},
+			{"!!", -1, ""},
+			{"*", -1, ""},
+			{"!*", -1, ""},
+			{"!$6$salt$hash", -1, "is locked"},
+			{"!!$6$salt$hash", -1, "is locked"},
+			{"$6$salt$hash", 20001, ""},
+			{"$6$salt$hash", 20000, "has expired"},
+			{"$6$salt$hash", 0, "has expired"},
+			{"!$6$salt$hash", 0, "is locked"},
+		}
+		for _, c := range cases {
+			entry := &shadowEntry{password: c.password, expire: c.expire}
+			err := entry.validate("alice", now)
+			if c.reason == "" {
+				So(err, ShouldBeNil)
+				continue
+			}
+			So(err, ShouldResemble, &DisabledAccountError{Name: "alice", Reason: c.reason})
+			So(err.Error(), ShouldEqual, "account alice "+c.reason)
+		}
+	})
+}
+
+func TestValidate(t *testing.T) {
+	Convey("Test account validation", t, func() {
+		// the account without shadow entry is valid.
+		So((&UserCred{User: &User{Name: "socker-no-such-user"}}).Validate(), ShouldBeNil)
+	})
+}
@@ -1,11 +1,18 @@
 package user
 
 import (
-	"os/user"
+	"fmt"
 	"strconv"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
+// credCacheTTL is how long a looked up credential is reused, the daemon acts
+// on behalf of many users for a long time.
+const credCacheTTL = time.Minute
+
 // User represents a user account.
 type User struct {
 	UID   int
@@ -22,57 +29,122 @@ type Group struct {
 	Users []string
 }
 
-// UserCred contains user's credential and user info.
+// UserCred contains user's credential and user info, it is shared by the
+// lookups and must not be modified.
 type UserCred struct {
-	User *user.User
-	Cred *syscall.Credential
+	*User
+	// Groups are the GIDs of the supplementary groups, the primary group is
+	// the first one.
+	Groups []int
+	Cred   *syscall.Credential
+}
+
+type cachedCred struct {
+	cred    *UserCred
+	expires time.Time
 }
 
+var credCache = struct {
+	sync.Mutex
+	byUID map[int]*cachedCred
+}{byUID: make(map[int]*cachedCred)}
+
 // GetUserCred returns a credential of specified user.
 func GetUserCred(username string) (*UserCred, error) {
-	u, err := user.Lookup(username)
+	u, err := LookupUser(username)
 	if err != nil {
 		return nil, err
 	}
-	return getUserCredByUID(u)
+	return getUserCred(u.UID, u)
 }
 
 // GetUserCredByUID returns a credential of specified user.
 func GetUserCredByUID(uid string) (*UserCred, error) {
-	u, err := user.LookupId(uid)
+	id, err := strconv.Atoi(uid)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("invalid uid %q", uid)
 	}
-	return getUserCredByUID(u)
+	return getUserCred(id, nil)
 }
 
-func getUserCredByUID(u *user.User) (*UserCred, error) {
-	unitUID, err := strconv.ParseUint(u.Uid, 10, 32)
-	if err != nil {
-		return nil, err
+// getUserCred returns the cached credential of uid, or looks it up if it is
+// missing or expired, u is used if it has been looked up by the caller.
+func getUserCred(uid int, u *User) (*UserCred, error) {
+	credCache.Lock()
+	cached, ok := credCache.byUID[uid]
+	credCache.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.cred, nil
 	}
-	unitGID, err := strconv.ParseUint(u.Uid, 10, 32)
+	if u == nil {
+		var err error
+		if u, err = LookupUserID(uid); err != nil {
+			return nil, err
+		}
+	}
+	cred, err := newUserCred(u)
 	if err != nil {
 		return nil, err
 	}
-	gids, err := u.GroupIds()
+	credCache.Lock()
+	credCache.byUID[uid] = &cachedCred{cred: cred, expires: time.Now().Add(credCacheTTL)}
+	credCache.Unlock()
+	return cred, nil
+}
+
+func newUserCred(u *User) (*UserCred, error) {
+	gids, err := u.GroupIDs()
 	if err != nil {
 		return nil, err
 	}
-	var groups []uint32
+	groups := make([]uint32, 0, len(gids))
 	for _, gid := range gids {
-		uintGid, err := strconv.ParseUint(gid, 10, 32)
-		if err != nil {
-			return nil, err
-		}
-		groups = append(groups, uint32(uintGid))
+		groups = append(groups, uint32(gid))
 	}
 	return &UserCred{
-		User: u,
+		User:   u,
+		Groups: gids,
 		Cred: &syscall.Credential{
-			Uid:    uint32(unitUID),
-			Gid:    uint32(unitGID),
+			Uid:    uint32(u.UID),
+			Gid:    uint32(u.GID),
 			Groups: groups,
 		},
 	}, nil
 }
+
+// DisabledAccountError is returned by Validate when the account is locked or
+// expired.
+type DisabledAccountError struct {
+	Name   string
+	Reason string
+}
+
+func (e *DisabledAccountError) Error() string {
+	return fmt.Sprintf("account %s %s", e.Name, e.Reason)
+}
+
+// Validate checks that the account is neither locked nor expired, so socker
+// does not act on behalf of a disabled user. The account is valid if its
+// shadow entry is not available, e.g. it is managed by a directory service
+// without shadow map. A failed lookup is not reported as a disabled account.
+func (c *UserCred) Validate() error {
+	entry, err := lookupShadow(c.Name)
+	if err != nil {
+		return fmt.Errorf("look up shadow entry of %s failed: %v", c.Name, err)
+	}
+	if entry == nil {
+		return nil
+	}
+	return entry.validate(c.Name, time.Now())
+}
+
+// PasswdEntry returns the user in the format of /etc/passwd.
+func (u *User) PasswdEntry() string {
+	return fmt.Sprintf("%s:x:%d:%d:%s:%s:%s", u.Name, u.UID, u.GID, u.Name,
+		u.Home, u.Shell)
+}
+
+// GroupEntry returns the group in the format of /etc/group.
+func (g *Group) GroupEntry() string {
+	return fmt.Sprintf("%s:x:%d:%s", g.Name, g.GID, strings.Join(g.Users, ","))
+}
@@ -3,6 +3,8 @@
 ## You should configure Slurm to enable epilog. This script will be excuted
 ## after each Slurm job termnated to delete corresponding container.
 recordFile=/var/lib/socker/epilog/$SLURM_JOB_ID
+## keep it the same as the job_scratch base of socker policy.
+scratchBase=${SOCKER_SCRATCH_BASE:-/tmp/socker}
 if [ -f $recordFile ];then
     echo "clean docker container for job: $SLURM_JOB_ID"
     containerName=`cat $recordFile`
@@ -14,3 +16,7 @@ if [ -f $recordFile ];then
     done
     rm -f $recordFile $ownerRecord $pidRecord
 fi
+if [ -d $scratchBase/$SLURM_JOB_ID ];then
+    echo "clean socker scratch directory for job: $SLURM_JOB_ID"
+    rm -rf $scratchBase/$SLURM_JOB_ID
+fi